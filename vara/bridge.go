@@ -0,0 +1,86 @@
+package vara
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Bridge relays the sessions accepted by a listener to an upstream TCP server, e.g. a CMS telnet
+// server, turning a VARA station into a simple gateway.
+type Bridge struct {
+	// Upstream is the address of the server to connect each session to, e.g. "server.winlink.org:8772"
+	Upstream string
+	// Dialer connects to Upstream; the zero value is fine
+	Dialer net.Dialer
+	// Logger receives the bridge's log output; defaults to the standard logger
+	Logger Logger
+}
+
+// Serve accepts sessions from ln until ctx is done or Accept fails, connecting each to Upstream and
+// copying data both ways. It closes ln when ctx is done, and waits for the sessions in progress to
+// end before returning.
+//
+// When the upstream server closes the connection, the session is closed once VARA has sent
+// everything still buffered. When the station hangs up, the upstream connection is closed.
+func (b *Bridge) Serve(ctx context.Context, ln net.Listener) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = ln.Close()
+		case <-stop:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil && errors.Is(err, net.ErrClosed) {
+				return ctx.Err()
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.relay(ctx, conn)
+		}()
+	}
+}
+
+// relay copies data between conn and a new upstream connection until either side closes.
+func (b *Bridge) relay(ctx context.Context, conn net.Conn) {
+	upstream, err := b.Dialer.DialContext(ctx, "tcp", b.Upstream)
+	if err != nil {
+		b.log().Printf("Bridging %s failed: %v", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	b.log().Debugf("bridging %s to %s", conn.RemoteAddr(), b.Upstream)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(conn, upstream)
+		// Closing the session waits for VARA to send what it has buffered
+		if err := conn.Close(); err != nil {
+			b.log().Debugf("closing %s: %v", conn.RemoteAddr(), err)
+		}
+	}()
+	_, _ = io.Copy(upstream, conn)
+	_ = upstream.Close()
+	<-done
+}
+
+func (b *Bridge) log() Logger {
+	if b.Logger == nil {
+		return stdLogger{}
+	}
+	return b.Logger
+}
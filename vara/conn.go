@@ -1,36 +1,1078 @@
 package vara
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
 	"net"
+	"os"
+	"sync"
+	"time"
 )
 
 // Wrapper for the data port connection we hand to clients. Implements net.Conn.
+//
+// Like other net.Conn implementations, it is safe for concurrent use: a goroutine reading and one
+// writing may race Close, Abort, the deadline setters and the accessors. Concurrent reads, and
+// concurrent writes, are serialized.
 type varaDataConn struct {
 	// the underlying TCP conn we're wrapping (type embedding)
 	net.TCPConn
 	// the parent modem hosting this connection
-	modem Modem
+	modem *Modem
+	// describes the session, kept for after it ends
+	info SessionInfo
+	// serializes writes, so periodic identification never splits a client write
+	writeMu     sync.Mutex
+	writeClosed bool          // set by CloseWrite, guarded by writeMu
+	done        chan struct{} // closed when Close starts
+	closeOnce   sync.Once
+	closed      chan struct{} // closed when Close is done
+	closedOnce  sync.Once
+
+	// gone is closed when the link is gone; Read then moves what is left on the socket to rest and
+	// closes it
+	gone     chan struct{}
+	goneOnce sync.Once
+	readMu   sync.Mutex
+	rest     *bytes.Reader // guarded by readMu
+
+	statsMu sync.Mutex
+	stats   Stats
+	ended   time.Time // when the session ended, guarded by statsMu
+
+	// writeDeadline is the deadline set with SetWriteDeadline; writeDeadlineChanged is closed when
+	// it changes
+	deadlineMu           sync.Mutex
+	writeDeadline        time.Time
+	writeDeadlineChanged chan struct{}
+	// linger is the Close behavior set with SetLinger, valid if lingerSet is set
+	lingerMu  sync.Mutex
+	linger    int
+	lingerSet bool
+
+	// endErr is why the link ended, as reads and writes report it: io.EOF if the remote station
+	// disconnected, ErrHungUp or ErrLinkStalled if this station did
+	endMu  sync.Mutex
+	endErr error
+
+	// event is closed and replaced whenever VARA reports its TX buffer, see bufferEvent; linkDown
+	// is set once the link is down
+	eventMu  sync.Mutex
+	event    chan struct{}
+	linkDown bool
+
+	// progress receives the TX buffer size while flushing, see SetFlushProgress
+	progressMu sync.Mutex
+	progress   func(remaining int)
+
+	// idleTimeout is the idle timeout, see SetIdleTimeout; lastActive is when data was last read or
+	// written, and idleChanged is closed when idleTimeout changes
+	idleMu      sync.Mutex
+	idleTimeout time.Duration
+	lastActive  time.Time
+	idleChanged chan struct{}
+	idleOnce    sync.Once
+
+	// stalled is closed when the link is aborted for making no progress, see
+	// ModemConfig.StallTimeout
+	stalled   chan struct{}
+	stallOnce sync.Once
+
+	// final is what VARA last reported about the link, frozen when the session ended so the
+	// modem's next session doesn't show through; nil until then. Guarded by modem.mu.
+	final *linkState
+}
+
+// linkState is what VARA reports about the link of a session.
+type linkState struct {
+	txBuffer                  int
+	txRate                    float64
+	registered, hasRegistered bool
+	quality                   LinkQuality
+	snr                       int
+	hasSNR                    bool
+}
+
+// linkState returns what VARA reported about the current link. The caller must hold mu.
+func (m *Modem) linkState() linkState {
+	return linkState{
+		txBuffer:      m.txBuffer,
+		txRate:        m.txRate,
+		registered:    m.linkRegistered,
+		hasRegistered: m.hasLinkRegistered,
+		quality:       m.quality,
+		snr:           m.snr,
+		hasSNR:        m.hasSNR,
+	}
+}
+
+// link returns what VARA reported about this session's link.
+func (v *varaDataConn) link() linkState {
+	v.modem.mu.Lock()
+	defer v.modem.mu.Unlock()
+	if v.final != nil {
+		return *v.final
+	}
+	return v.modem.linkState()
+}
+
+// freezeLink keeps what VARA reported about the link as the session ends. The caller must hold
+// modem.mu.
+func (v *varaDataConn) freezeLink() {
+	if v.final == nil {
+		final := v.modem.linkState()
+		v.final = &final
+	}
+}
+
+// Stats holds transfer statistics for a connection.
+type Stats struct {
+	// BytesWritten is the number of bytes handed to VARA for transmission
+	BytesWritten int64
+	// BytesRead is the number of bytes received from the remote station
+	BytesRead int64
+	// Started is when the connection was established
+	Started time.Time
+	// Duration is how long the session has lasted so far, or lasted in total once it ended
+	Duration time.Duration
+	// BufferStalls is how many writes had to wait for VARA's TX buffer to drain
+	BufferStalls int
+	// Bandwidth of the session as reported by VARA, see Bandwidth
+	Bandwidth string
+}
+
+func newDataConn(m *Modem, dataConn *net.TCPConn, inbound bool) *varaDataConn {
+	started := time.Now()
+	config := m.currentConfig()
+	v := &varaDataConn{
+		TCPConn: *dataConn,
+		modem:   m,
+		done:    make(chan struct{}),
+		closed:  make(chan struct{}),
+		gone:    make(chan struct{}),
+		stalled: make(chan struct{}),
+		event:   make(chan struct{}),
+
+		idleTimeout: config.IdleTimeout,
+		lastActive:  started,
+		idleChanged: make(chan struct{}),
+	}
+	m.mu.Lock()
+	v.info = SessionInfo{
+		LocalCall:  m.fromCall,
+		RemoteCall: m.toCall,
+		Inbound:    inbound,
+		Bandwidth:  m.linkBandwidth,
+		Mode:       m.session,
+		Started:    started,
+	}
+	m.current = v
+	m.mu.Unlock()
+	if config.IDInterval > 0 && config.IDText != "" {
+		go v.identify(config.IDInterval, config.IDText)
+	}
+	if config.MaxSessionDuration > 0 {
+		cmds, cancel := m.cmdSubscribe()
+		go v.limitDuration(config.MaxSessionDuration, cmds, cancel)
+	}
+	if config.IdleTimeout > 0 {
+		v.startIdleWatch()
+	}
+	if config.KeepAliveInterval > 0 {
+		go v.keepAlive(config.KeepAliveInterval, config.KeepAliveText)
+	}
+	if config.StallTimeout > 0 {
+		go v.watchStall(config.StallTimeout)
+	}
+	cmds, cancel := m.cmdSubscribe()
+	go v.watchBuffer(cmds, cancel)
+	go v.reconcileTxBuffer(txReconcileInterval)
+	return v
+}
+
+// Read reads data from the connection. It honors SetReadDeadline: once the deadline has passed, it
+// fails with an error wrapping os.ErrDeadlineExceeded.
+//
+// Once the link is gone, Read still returns the data VARA delivered before the disconnect. After
+// that it fails with io.EOF only if the remote station disconnected, and with ErrHungUp or
+// ErrLinkStalled if this station ended the session. After Close or Abort, it fails with an error
+// wrapping net.ErrClosed. A zero-length read returns right away.
+//
+// "Overrides" net.Conn.Read.
+func (v *varaDataConn) Read(b []byte) (int, error) {
+	v.readMu.Lock()
+	defer v.readMu.Unlock()
+	if v.isClosed() {
+		return 0, v.closedError("read")
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var n int
+	var err error
+	if v.rest == nil {
+		n, err = v.TCPConn.Read(b)
+		if err != nil && v.isClosed() {
+			return n, v.closedError("read")
+		}
+		if err != nil && v.isGone() {
+			if n == 0 {
+				v.drain()
+				n, err = v.rest.Read(b)
+			} else {
+				err = nil
+			}
+		}
+	} else {
+		n, err = v.rest.Read(b)
+	}
+	if err == io.EOF && v.rest != nil {
+		err = v.endError()
+	}
+	v.statsMu.Lock()
+	v.stats.BytesRead += int64(n)
+	v.statsMu.Unlock()
+	if n > 0 {
+		v.active()
+	}
+	return n, err
+}
+
+// Write writes data to the connection. It blocks while VARA's TX buffer is too full, see
+// ModemConfig.TxThrottleFactor, ModemConfig.TxBufferTarget and ModemConfig.WriteChunkSize. A
+// zero-length write returns right away.
+//
+// Once the session has ended, Write fails with io.EOF if the remote station disconnected,
+// ErrHungUp or ErrLinkStalled if this station ended it, and net.ErrClosed after Close or Abort.
+//
+// "Overrides" net.Conn.Write.
+func (v *varaDataConn) Write(b []byte) (int, error) {
+	return v.write(context.Background(), b)
+}
+
+func (v *varaDataConn) write(ctx context.Context, b []byte) (int, error) {
+	n, err := v.send(ctx, b)
+	if n > 0 {
+		v.active()
+	}
+	return n, err
+}
+
+// send writes b like Write, but doesn't count as activity for the idle timeout and keepalive.
+func (v *varaDataConn) send(ctx context.Context, b []byte) (int, error) {
+	v.writeMu.Lock()
+	defer v.writeMu.Unlock()
+	if v.writeClosed || v.isClosed() {
+		return 0, v.closedError("write")
+	}
+	if err := v.endError(); err != nil {
+		return 0, err
+	}
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if size := v.modem.currentConfig().WriteChunkSize; size > 0 && len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		if err := v.waitTxBuffer(ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := v.TCPConn.Write(chunk)
+		if err != nil && v.isClosed() {
+			err = v.closedError("write")
+		} else if err != nil && v.isGone() {
+			err = v.linkError()
+		}
+		v.modem.mu.Lock()
+		if v.modem.txBuffer == 0 {
+			v.modem.txProgress = time.Now()
+		}
+		v.modem.txBuffer += n
+		v.modem.lastWrite = time.Now()
+		v.modem.mu.Unlock()
+		v.statsMu.Lock()
+		v.stats.BytesWritten += int64(n)
+		v.statsMu.Unlock()
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// txLimit returns how full VARA's TX buffer may be for Write to queue n more bytes, or -1 if
+// throttling is disabled. See ModemConfig.TxThrottleFactor and ModemConfig.TxBufferTarget.
+func (m *Modem) txLimit(n int) int {
+	m.mu.Lock()
+	rate, target := m.txRate, m.config.TxBufferTarget
+	m.mu.Unlock()
+	if target > 0 && rate > 0 {
+		return int(rate * target.Seconds())
+	}
+	factor := m.txThrottleFactor()
+	if factor < 0 {
+		return -1
+	}
+	return factor * n
+}
+
+// txThrottleFactor returns ModemConfig.TxThrottleFactor, or the default for the modem type.
+func (m *Modem) txThrottleFactor() int {
+	if factor := m.currentConfig().TxThrottleFactor; factor != 0 {
+		return factor
+	}
+	return txThrottleFactors[m.scheme]
+}
+
+// ReadFrom writes the data read from r until EOF to the connection, in chunks of
+// ModemConfig.WriteChunkSize (4096 bytes by default) throttled like Write. It implements
+// io.ReaderFrom, so io.Copy uploads large files efficiently.
+//
+// "Overrides" net.TCPConn.ReadFrom, which would bypass the throttling.
+func (v *varaDataConn) ReadFrom(r io.Reader) (int64, error) {
+	size := v.modem.currentConfig().WriteChunkSize
+	if size == 0 {
+		size = readFromChunkSize
+	}
+	buf := make([]byte, size)
+	var total int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			written, werr := v.write(context.Background(), buf[:n])
+			total += int64(written)
+			if werr != nil {
+				return total, werr
+			}
+		}
+		switch {
+		case err == io.EOF:
+			return total, nil
+		case err != nil:
+			return total, err
+		}
+	}
+}
+
+// WriteTo writes the data read from the connection to w until EOF, like io.Copy would with Read.
+//
+// "Overrides" net.TCPConn.WriteTo, which would read the socket directly and bypass Read's
+// handling of disconnects and its statistics.
+func (v *varaDataConn) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, struct{ io.Reader }{v})
+}
+
+// Stats returns the connection's transfer statistics so far. It is safe to call while the
+// connection is in use.
+func (v *varaDataConn) Stats() Stats {
+	v.statsMu.Lock()
+	defer v.statsMu.Unlock()
+	stats := v.stats
+	stats.Started, stats.Bandwidth = v.info.Started, v.info.Bandwidth
+	if v.ended.IsZero() {
+		stats.Duration = time.Since(stats.Started)
+	} else {
+		stats.Duration = v.ended.Sub(stats.Started)
+	}
+	return stats
+}
+
+// end records that the session ended.
+func (v *varaDataConn) end() {
+	v.statsMu.Lock()
+	defer v.statsMu.Unlock()
+	if v.ended.IsZero() {
+		v.ended = time.Now()
+	}
+}
+
+// waitTxBuffer blocks until VARA's TX buffer is small enough to queue n more bytes.
+func (v *varaDataConn) waitTxBuffer(ctx context.Context, n int) error {
+	fits := func() bool {
+		limit := v.modem.txLimit(n)
+		return limit < 0 || v.TxBufferLen() <= limit
+	}
+	if fits() {
+		return nil
+	}
+	v.statsMu.Lock()
+	v.stats.BufferStalls++
+	v.statsMu.Unlock()
+	return v.waitBuffer(ctx, fits)
+}
+
+// waitBuffer blocks until ready returns true, checking again whenever VARA reports its TX buffer.
+func (v *varaDataConn) waitBuffer(ctx context.Context, ready func() bool) error {
+	for {
+		event, down := v.bufferEvent()
+		if ready() {
+			return nil
+		}
+		if down {
+			return v.linkError()
+		}
+		deadline, changed, stop := v.writeTimer()
+		select {
+		case <-ctx.Done():
+			stop()
+			return ctx.Err()
+		case <-event:
+		case <-deadline:
+			return v.timeoutError()
+		case <-v.stalled:
+			stop()
+			return ErrLinkStalled
+		case <-v.done:
+			stop()
+			return v.closedError("write")
+		case <-changed:
+		case <-time.After(v.modem.currentConfig().BufferTimeout):
+			stop()
+			return errors.New("timeout waiting for VARA to drain its TX buffer")
+		}
+		stop()
+	}
+}
+
+// bufferEvent returns a channel closed at VARA's next TX buffer report, and whether the link is
+// down, in which case no more reports come.
+func (v *varaDataConn) bufferEvent() (event <-chan struct{}, down bool) {
+	v.eventMu.Lock()
+	defer v.eventMu.Unlock()
+	return v.event, v.linkDown
+}
+
+// watchBuffer passes VARA's TX buffer reports on to bufferEvent until the link goes down or Close
+// is done. Sharing one subscription keeps writes from missing reports in between.
+func (v *varaDataConn) watchBuffer(cmds <-chan Event, cancel func()) {
+	defer cancel()
+	for {
+		select {
+		case <-v.closed:
+			return
+		case ev, ok := <-cmds:
+			if !ok {
+				v.setEndError(ErrModemClosed)
+			}
+			_, buffer := ev.(Buffer)
+			down := !ok || ev == (Disconnected{})
+			if down || buffer {
+				v.eventMu.Lock()
+				v.linkDown = down
+				close(v.event)
+				v.event = make(chan struct{})
+				v.eventMu.Unlock()
+			}
+			if down {
+				return
+			}
+		}
+	}
+}
+
+// Flush blocks until VARA's TX buffer is empty, i.e. the remote station has acknowledged everything
+// written so far. It fails if VARA reports no progress for ModemConfig.BufferTimeout, and honors
+// the write deadline.
+func (v *varaDataConn) Flush() error {
+	return v.FlushContext(context.Background())
+}
+
+// FlushContext is like Flush, but gives up and returns ctx.Err() when ctx is done.
+func (v *varaDataConn) FlushContext(ctx context.Context) error {
+	return v.flush(ctx)
+}
+
+func (v *varaDataConn) flush(ctx context.Context) error {
+	defer v.watchProgress()()
+	return v.waitBuffer(ctx, func() bool { return v.TxBufferLen() == 0 })
+}
+
+// SetFlushProgress sets a function receiving the number of bytes left in VARA's TX buffer while
+// Flush, CloseWrite or Close wait for it to drain, e.g. to show the progress to the user. It is
+// called when the wait starts and whenever VARA reports progress, from another goroutine.
+func (v *varaDataConn) SetFlushProgress(fn func(remaining int)) {
+	v.progressMu.Lock()
+	defer v.progressMu.Unlock()
+	v.progress = fn
+}
+
+// watchProgress reports the TX buffer size to the SetFlushProgress function, if any, until the
+// returned function is called.
+func (v *varaDataConn) watchProgress() (stop func()) {
+	v.progressMu.Lock()
+	fn := v.progress
+	v.progressMu.Unlock()
+	if fn == nil {
+		return func() {}
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		event, down := v.bufferEvent()
+		fn(v.TxBufferLen())
+		for !down {
+			select {
+			case <-event:
+				event, down = v.bufferEvent()
+				fn(v.TxBufferLen())
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// timeoutError is the error of a write that missed its deadline.
+func (v *varaDataConn) timeoutError() error {
+	return &net.OpError{Op: "write", Net: network, Source: v.LocalAddr(), Addr: v.RemoteAddr(), Err: os.ErrDeadlineExceeded}
+}
+
+// CloseWrite waits for VARA to transmit everything written so far, then shuts down the writing
+// side of the connection: further writes fail, while Read keeps working until the remote station
+// disconnects. VARA has no notion of half-closed links, so the remote station isn't told; the
+// application protocol must tell it that no more data follows.
+func (v *varaDataConn) CloseWrite() error {
+	v.writeMu.Lock()
+	defer v.writeMu.Unlock()
+	if err := v.flush(context.Background()); err != nil {
+		return err
+	}
+	v.writeClosed = true
+	return nil
+}
+
+// SetDeadline sets the read and write deadlines, see SetReadDeadline and SetWriteDeadline.
+//
+// "Overrides" net.Conn.SetDeadline.
+func (v *varaDataConn) SetDeadline(t time.Time) error {
+	if err := v.TCPConn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return v.SetWriteDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for Write, including while it waits for VARA's TX buffer to
+// drain. Once it has passed, Write fails with an error wrapping os.ErrDeadlineExceeded.
+//
+// "Overrides" net.Conn.SetWriteDeadline.
+func (v *varaDataConn) SetWriteDeadline(t time.Time) error {
+	v.deadlineMu.Lock()
+	v.writeDeadline = t
+	if v.writeDeadlineChanged != nil {
+		close(v.writeDeadlineChanged)
+	}
+	v.writeDeadlineChanged = make(chan struct{})
+	v.deadlineMu.Unlock()
+	return v.TCPConn.SetWriteDeadline(t)
+}
+
+// writeTimer returns a channel that fires at the write deadline (nil if none), a channel closed
+// when the deadline changes and a function to release the timer.
+func (v *varaDataConn) writeTimer() (deadline <-chan time.Time, changed <-chan struct{}, stop func()) {
+	v.deadlineMu.Lock()
+	if v.writeDeadlineChanged == nil {
+		v.writeDeadlineChanged = make(chan struct{})
+	}
+	t, changed := v.writeDeadline, v.writeDeadlineChanged
+	v.deadlineMu.Unlock()
+	if t.IsZero() {
+		return nil, changed, func() {}
+	}
+	timer := time.NewTimer(time.Until(t))
+	return timer.C, changed, func() { timer.Stop() }
+}
+
+// TxBufferLen returns the number of bytes queued in VARA's TX buffer, i.e. not yet acknowledged by
+// the remote station. It counts writes right away and follows VARA's BUFFER reports, falling back
+// to the last report once writing has paused for a few seconds.
+func (v *varaDataConn) TxBufferLen() int {
+	return v.link().txBuffer
+}
+
+// Throughput returns the rate (bytes/s) at which the remote station has recently been
+// acknowledging data while VARA was transmitting, derived from how fast VARA's TX buffer shrinks,
+// as VARA doesn't report it directly. ok is false until a rate has been measured in this session.
+func (v *varaDataConn) Throughput() (bytesPerSec float64, ok bool) {
+	link := v.link()
+	return link.txRate, link.txRate > 0
+}
+
+// EstimatedFlushDuration estimates how long VARA needs to transmit what is queued in its TX buffer,
+// at the rate it has been draining it in this session, e.g. to predict how long Flush or Close
+// will take. ok is false if data is queued but no rate has been measured yet.
+func (v *varaDataConn) EstimatedFlushDuration() (d time.Duration, ok bool) {
+	link := v.link()
+	switch {
+	case link.txBuffer == 0:
+		return 0, true
+	case link.txRate == 0:
+		return 0, false
+	}
+	return time.Duration(float64(link.txBuffer) / link.txRate * float64(time.Second)), true
+}
+
+// CleanTXBuffer makes VARA discard the data queued in its TX buffer that it hasn't transmitted yet,
+// e.g. when abandoning a session, and resets TxBufferLen.
+func (v *varaDataConn) CleanTXBuffer() error {
+	v.writeMu.Lock()
+	defer v.writeMu.Unlock()
+	if err := v.modem.writeCmd("CLEANTXBUFFER"); err != nil {
+		return err
+	}
+	v.modem.mu.Lock()
+	v.modem.txBuffer, v.modem.txReported = 0, 0
+	v.modem.mu.Unlock()
+	return nil
 }
 
 // Close closes the connection.
-// Any blocked Read or Write operations will be unblocked and return errors.
+// Any blocked Read or Write operations will be unblocked and return errors. Once closed, reads,
+// writes and further calls to Close fail with an error wrapping net.ErrClosed.
+//
+// By default, Close disconnects gracefully, which lets VARA transmit everything still queued and
+// may take a while on a slow link; see SetLinger to abort instead.
 //
 // "Overrides" net.Conn.Close.
 func (v *varaDataConn) Close() error {
-	// If client wants to close the data stream, close down RF and TCP as well
-	return v.modem.Close()
+	first := false
+	v.closeOnce.Do(func() {
+		first = true
+		close(v.done)
+	})
+	if !first {
+		return v.closedError("close")
+	}
+	return v.shutdown()
+}
+
+// shutdown ends the session for Close and Abort.
+func (v *varaDataConn) shutdown() error {
+	// Unblock the reads and writes in progress; they fail from now on
+	_ = v.TCPConn.SetDeadline(time.Now())
+	timeout := v.modem.currentConfig().DisconnectTimeout
+	v.lingerMu.Lock()
+	if v.lingerSet {
+		timeout = time.Duration(v.linger) * time.Second
+	}
+	v.lingerMu.Unlock()
+	// If client wants to close the data stream, close down RF and TCP as well, unless the session
+	// has ended already and the modem moved on
+	var err error
+	v.modem.mu.Lock()
+	current := v.modem.current == v
+	v.modem.mu.Unlock()
+	if current {
+		stop := v.watchProgress()
+		err = v.modem.closeSession(timeout)
+		stop()
+		v.modem.endSession()
+	}
+	_ = v.TCPConn.Close()
+	v.closedOnce.Do(func() { close(v.closed) })
+	return err
+}
+
+func (v *varaDataConn) isClosed() bool {
+	select {
+	case <-v.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// closedError returns the error op fails with once the connection is closed.
+func (v *varaDataConn) closedError(op string) error {
+	return &net.OpError{Op: op, Net: network, Source: v.LocalAddr(), Addr: v.RemoteAddr(), Err: net.ErrClosed}
+}
+
+// Abort drops the link right away, discarding whatever VARA still has queued, e.g. when the user
+// cancels the session. Read, Write and Flush calls in progress are unblocked and fail. It also cuts
+// short a Close waiting for a graceful disconnect.
+func (v *varaDataConn) Abort() error {
+	_ = v.SetLinger(0)
+	v.closeOnce.Do(func() { close(v.done) })
+	return v.shutdown()
+}
+
+// SetLinger sets how Close treats data queued in VARA's TX buffer, like net.TCPConn.SetLinger. With
+// sec < 0 (the default), Close disconnects gracefully and waits up to ModemConfig.DisconnectTimeout
+// for VARA to send the queue first. With sec == 0, Close aborts the link right away and the queue
+// is discarded, e.g. when the user cancels the session. With sec > 0, Close waits up to sec seconds
+// for the graceful disconnect before aborting.
+//
+// "Overrides" net.TCPConn.SetLinger.
+func (v *varaDataConn) SetLinger(sec int) error {
+	v.lingerMu.Lock()
+	defer v.lingerMu.Unlock()
+	v.linger, v.lingerSet = sec, sec >= 0
+	return nil
+}
+
+// linkGone makes Read return what is left on the data socket, then the end error, and closes the
+// socket. It is called when VARA reports the session disconnected.
+func (v *varaDataConn) linkGone() {
+	v.setEndError(io.EOF)
+	v.goneOnce.Do(func() { close(v.gone) })
+	// Wake up a waiting Read, which then drains the socket itself
+	_ = v.TCPConn.SetReadDeadline(time.Now())
+	go func() {
+		v.readMu.Lock()
+		defer v.readMu.Unlock()
+		v.drain()
+	}()
+}
+
+func (v *varaDataConn) isGone() bool {
+	select {
+	case <-v.gone:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain reads what is left on the data socket into rest and closes the socket. The caller must hold
+// readMu.
+func (v *varaDataConn) drain() {
+	if v.rest != nil {
+		return
+	}
+	var buf bytes.Buffer
+	_ = v.TCPConn.SetReadDeadline(time.Now().Add(drainTimeout))
+	_, _ = buf.ReadFrom(&v.TCPConn)
+	if err := v.TCPConn.Close(); err != nil {
+		v.modem.debugf("closing data connection failed: %v", err)
+	}
+	v.rest = bytes.NewReader(buf.Bytes())
+}
+
+// reconcileTxBuffer corrects the TX buffer count every interval until the session ends. VARA
+// reports the buffer size whenever it queues data, so once nothing has been written for an
+// interval, its last report is the truth; the count drifts when a report overtakes the write it
+// covers, or a report is missed.
+func (v *varaDataConn) reconcileTxBuffer(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-v.done:
+			return
+		case <-v.gone:
+			return
+		case now := <-ticker.C:
+			m := v.modem
+			m.mu.Lock()
+			counted, reported := m.txBuffer, m.txReported
+			drifted := counted != reported && now.Sub(m.lastWrite) >= interval
+			if drifted {
+				m.txBuffer = reported
+			}
+			m.mu.Unlock()
+			if drifted {
+				m.debugf("corrected TX buffer count from %d to %d bytes", counted, reported)
+			}
+		}
+	}
+}
+
+// SetIdleTimeout sets how long the session may go without data being read or written before it is
+// disconnected, overriding ModemConfig.IdleTimeout. Zero disables the timeout.
+func (v *varaDataConn) SetIdleTimeout(d time.Duration) {
+	v.idleMu.Lock()
+	v.idleTimeout = d
+	close(v.idleChanged)
+	v.idleChanged = make(chan struct{})
+	v.idleMu.Unlock()
+	if d > 0 {
+		v.startIdleWatch()
+	}
+}
+
+// active records that data was read or written.
+func (v *varaDataConn) active() {
+	v.idleMu.Lock()
+	v.lastActive = time.Now()
+	v.idleMu.Unlock()
 }
 
-// LocalAddr returns the local network address.
+func (v *varaDataConn) startIdleWatch() {
+	v.idleOnce.Do(func() {
+		cmds, cancel := v.modem.cmdSubscribe()
+		go v.watchIdle(cmds, cancel)
+	})
+}
+
+// watchIdle disconnects the session once it has been idle for the idle timeout, unless it ends
+// first.
+func (v *varaDataConn) watchIdle(cmds <-chan Event, cancel func()) {
+	defer cancel()
+	for {
+		v.idleMu.Lock()
+		timeout, lastActive, changed := v.idleTimeout, v.lastActive, v.idleChanged
+		v.idleMu.Unlock()
+		var expired <-chan time.Time
+		stop := func() {}
+		if timeout > 0 {
+			timer := time.NewTimer(time.Until(lastActive.Add(timeout)))
+			expired, stop = timer.C, func() { timer.Stop() }
+		}
+		select {
+		case <-v.done:
+			stop()
+			return
+		case ev, ok := <-cmds:
+			if !ok || ev == (Disconnected{}) {
+				stop()
+				return
+			}
+		case <-changed:
+		case <-expired:
+			v.idleMu.Lock()
+			idle := v.lastActive.Equal(lastActive)
+			v.idleMu.Unlock()
+			if idle {
+				v.modem.logf("session idle for %v, disconnecting", timeout)
+				v.setEndError(ErrHungUp)
+				v.modem.hangUp()
+				return
+			}
+		}
+		stop()
+	}
+}
+
+// watchStall aborts the link once VARA's TX buffer has held data without shrinking for d, unless
+// the session ends first.
+func (v *varaDataConn) watchStall(d time.Duration) {
+	ticker := time.NewTicker(d / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-v.done:
+			return
+		case <-v.gone:
+			return
+		case now := <-ticker.C:
+			m := v.modem
+			m.mu.Lock()
+			stalled := m.txBuffer > 0 && !m.txProgress.IsZero() && now.Sub(m.txProgress) >= d
+			m.mu.Unlock()
+			if !stalled {
+				continue
+			}
+			m.logf("no progress sending the TX buffer for %v, aborting", d)
+			v.setEndError(ErrLinkStalled)
+			v.stallOnce.Do(func() { close(v.stalled) })
+			if err := m.closeSession(0); err != nil {
+				m.debugf("abort failed: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// linkError returns the error for writes failing because the link went down.
+func (v *varaDataConn) linkError() error {
+	if err := v.endError(); err != nil {
+		return err
+	}
+	return ErrModemClosed
+}
+
+// setEndError records why the link ended, unless that is known already.
+func (v *varaDataConn) setEndError(err error) {
+	v.endMu.Lock()
+	defer v.endMu.Unlock()
+	if v.endErr == nil {
+		v.endErr = err
+	}
+}
+
+func (v *varaDataConn) endError() error {
+	v.endMu.Lock()
+	defer v.endMu.Unlock()
+	return v.endErr
+}
+
+// keepAlive sends text whenever nothing has been read or written for interval, until the session
+// ends.
+func (v *varaDataConn) keepAlive(interval time.Duration, text string) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	var lastSent time.Time
+	for {
+		select {
+		case <-v.done:
+			return
+		case <-v.gone:
+			return
+		case <-timer.C:
+		}
+		v.idleMu.Lock()
+		last := v.lastActive
+		v.idleMu.Unlock()
+		if last.Before(lastSent) {
+			last = lastSent
+		}
+		if wait := time.Until(last.Add(interval)); wait > 0 {
+			timer.Reset(wait)
+			continue
+		}
+		if _, err := v.send(context.Background(), []byte(text)); err != nil {
+			v.modem.debugf("keepalive failed: %v", err)
+			return
+		}
+		lastSent = time.Now()
+		timer.Reset(interval)
+	}
+}
+
+// identify sends text every interval until the connection is closed. Like keepalives, the
+// identifications don't keep an idle session alive.
+func (v *varaDataConn) identify(interval time.Duration, text string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-v.done:
+			return
+		case <-ticker.C:
+			if _, err := v.send(context.Background(), []byte(text)); err != nil {
+				v.modem.debugf("identification failed: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// limitDuration disconnects the session once it has lasted d, unless it ends first.
+func (v *varaDataConn) limitDuration(d time.Duration, cmds <-chan Event, cancel func()) {
+	defer cancel()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-v.done:
+			return
+		case ev, ok := <-cmds:
+			if !ok || ev == (Disconnected{}) {
+				return
+			}
+		case <-timer.C:
+			v.modem.logf("session reached the maximum duration of %v, disconnecting", d)
+			v.setEndError(ErrHungUp)
+			v.modem.hangUp()
+			return
+		}
+	}
+}
+
+// LocalAddr returns the local network address. For a session accepted by the listener, this is
+// the callsign the remote station called, which is one of the aliases if any are in use.
 //
 // "Overrides" net.Conn.LocalAddr.
 func (v *varaDataConn) LocalAddr() net.Addr {
-	return Addr{v.modem.myCall}
+	return Addr{v.info.LocalCall}
 }
 
 // RemoteAddr returns the remote network address.
 //
 // "Overrides" net.Conn.RemoteAddr.
 func (v *varaDataConn) RemoteAddr() net.Addr {
-	return Addr{v.modem.toCall}
+	return Addr{v.info.RemoteCall}
+}
+
+// WriteContext is like Write, but returns ctx.Err() if ctx is done before the write completes,
+// including while blocked waiting for VARA's TX buffer to drain.
+//
+// A cancelled WriteContext resets the write deadline.
+func (v *varaDataConn) WriteContext(ctx context.Context, b []byte) (int, error) {
+	if ctx.Done() == nil {
+		return v.Write(b)
+	}
+
+	// Unblock the write by expiring its deadline if ctx is done first, then put back the caller's
+	var saved time.Time
+	expired := false
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			v.deadlineMu.Lock()
+			saved = v.writeDeadline
+			v.deadlineMu.Unlock()
+			expired = true
+			_ = v.SetWriteDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	n, err := v.write(ctx, b)
+	close(stop)
+	<-stopped
+	if expired {
+		_ = v.SetWriteDeadline(saved)
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return n, ctxErr
+	}
+	return n, err
+}
+
+// Bandwidth returns the bandwidth of this session as reported by VARA when the link was
+// established: "500", "2300" or "2750" (Hz) with VARA HF, "WIDE" or "NARROW" with VARA FM. It is
+// empty if VARA didn't report one, as is the case with VARA SAT.
+func (v *varaDataConn) Bandwidth() string {
+	return v.info.Bandwidth
+}
+
+// LinkRegistered reports whether VARA runs this session at full speed, as told by its registration
+// status. ok is false if VARA hasn't reported it.
+func (v *varaDataConn) LinkRegistered() (registered, ok bool) {
+	link := v.link()
+	return link.registered, link.hasRegistered
+}
+
+// SessionInfo returns a description of the session.
+func (v *varaDataConn) SessionInfo() SessionInfo {
+	return v.info
+}
+
+// LinkQuality summarizes the S/N reports VARA made during a session.
+type LinkQuality struct {
+	// Reports is the number of S/N reports; the other fields are only valid if it is nonzero
+	Reports int
+	// Last, Min and Max are the most recent, lowest and highest S/N (dB)
+	Last, Min, Max int
+	// Mean is the average S/N (dB)
+	Mean float64
+}
+
+// LinkQuality returns a summary of the S/N reports VARA made during this session, e.g. to log the
+// link quality alongside the transfer results.
+//
+// VARA only reports S/N while CHAT mode is on.
+func (v *varaDataConn) LinkQuality() LinkQuality {
+	return v.link().quality
+}
+
+// SignalReport returns the signal-to-noise ratio (dB) most recently reported by VARA during this
+// session. ok is false if there has been no report yet.
+//
+// VARA only reports S/N while CHAT mode is on.
+func (v *varaDataConn) SignalReport() (snr int, ok bool) {
+	link := v.link()
+	return link.snr, link.hasSNR
 }
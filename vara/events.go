@@ -0,0 +1,192 @@
+package vara
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Event is something VARA reports on its command port, as parsed by ParseEvent: one of Connected,
+// Disconnected, Buffer, Busy, PTT, Pending, CancelPending, Reply, Version, SN, CQFrame, Registered,
+// LinkRegistration, IAmAlive, MissingSoundcard or Unknown.
+type Event interface {
+	event()
+}
+
+// Connected reports a link established, e.g. "CONNECTED N0CALL LA1B 2300" (VARA HF), "CONNECTED
+// N0CALL LA1B" (VARA SAT) or "CONNECTED N0CALL LA1B via LA1D WIDE" (VARA FM).
+type Connected struct {
+	// Src is the station that initiated the link, Dst the station it called
+	Src, Dst string
+	// Via lists the digipeaters the link goes through, if any (VARA FM)
+	Via []string
+	// Bandwidth is the bandwidth of the link, e.g. "2300" or "WIDE", if VARA reported it
+	Bandwidth string
+}
+
+// Disconnected reports the link gone ("DISCONNECTED").
+type Disconnected struct{}
+
+// Buffer reports the number of bytes in VARA's TX buffer, e.g. "BUFFER 1024".
+type Buffer struct{ N int }
+
+// Busy reports whether VARA hears activity on the channel ("BUSY ON" or "BUSY OFF").
+type Busy struct{ On bool }
+
+// PTT reports VARA wanting to start or stop transmitting ("PTT ON" or "PTT OFF").
+type PTT struct{ On bool }
+
+// Pending reports a connect request under way ("PENDING").
+type Pending struct{}
+
+// CancelPending reports a pending connect request that came to nothing ("CANCELPENDING").
+type CancelPending struct{}
+
+// Reply is VARA's answer to a command: "OK", or "WRONG" if VARA rejected it.
+type Reply struct{ OK bool }
+
+// Version answers the VERSION command, e.g. "VERSION 4.7.3".
+type Version struct{ Release string }
+
+// SN is a signal-to-noise report (dB), e.g. "SN 12" or "SN -3.5".
+type SN struct{ SNR float64 }
+
+// CQFrame reports a CQ heard on the channel, e.g. "CQFRAME LA1B 500" (VARA HF) or "CQFRAME LA1B
+// LA1D LA1E" (VARA FM).
+type CQFrame struct {
+	// Src is the calling station
+	Src string
+	// Via lists the digipeaters the frame came through, if any (VARA FM)
+	Via []string
+	// Bandwidth is the bandwidth the station calls on, if given (VARA HF)
+	Bandwidth string
+}
+
+// Registered reports the callsign VARA is registered to, e.g. "REGISTERED N0CALL".
+type Registered struct{ Call string }
+
+// LinkRegistration reports whether the current link is registered ("LINK REGISTERED" or "LINK
+// UNREGISTERED"). VARA caps the speed of unregistered links.
+type LinkRegistration struct{ Registered bool }
+
+// IAmAlive is VARA's periodic sign of life ("IAMALIVE").
+type IAmAlive struct{}
+
+// MissingSoundcard reports VARA losing its soundcard ("MISSING SOUNDCARD").
+type MissingSoundcard struct{}
+
+// Unknown is a command ParseEvent doesn't know.
+type Unknown struct{ Cmd string }
+
+func (Connected) event()        {}
+func (Disconnected) event()     {}
+func (Buffer) event()           {}
+func (Busy) event()             {}
+func (PTT) event()              {}
+func (Pending) event()          {}
+func (CancelPending) event()    {}
+func (Reply) event()            {}
+func (Version) event()          {}
+func (SN) event()               {}
+func (CQFrame) event()          {}
+func (Registered) event()       {}
+func (LinkRegistration) event() {}
+func (IAmAlive) event()         {}
+func (MissingSoundcard) event() {}
+func (Unknown) event()          {}
+
+// ParseEvent parses a command VARA sent on its command port, without the trailing "\r". Commands it
+// doesn't know are returned as Unknown; it fails if a known one is malformed.
+func ParseEvent(cmd string) (Event, error) {
+	switch cmd {
+	case "DISCONNECTED":
+		return Disconnected{}, nil
+	case "BUSY ON", "BUSY OFF":
+		return Busy{On: cmd == "BUSY ON"}, nil
+	case "PTT ON", "PTT OFF":
+		return PTT{On: cmd == "PTT ON"}, nil
+	case "PENDING":
+		return Pending{}, nil
+	case "CANCELPENDING":
+		return CancelPending{}, nil
+	case "OK", "WRONG":
+		return Reply{OK: cmd == "OK"}, nil
+	case "IAMALIVE":
+		return IAmAlive{}, nil
+	case "MISSING SOUNDCARD":
+		return MissingSoundcard{}, nil
+	case "LINK REGISTERED", "LINK UNREGISTERED":
+		return LinkRegistration{Registered: cmd == "LINK REGISTERED"}, nil
+	}
+
+	parts := strings.Fields(cmd)
+	if len(parts) == 0 {
+		return Unknown{cmd}, nil
+	}
+	switch parts[0] {
+	case "CONNECTED":
+		return parseConnected(parts), nil
+	case "BUFFER":
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed buffer report: %q", cmd)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed buffer report: %q", cmd)
+		}
+		return Buffer{n}, nil
+	case "SN":
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed S/N report: %q", cmd)
+		}
+		snr, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed S/N report: %q", cmd)
+		}
+		return SN{snr}, nil
+	case "CQFRAME":
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("malformed CQ frame: %q", cmd)
+		}
+		ev := CQFrame{Src: parts[1]}
+		if len(parts) == 3 && contains(bandwidths, parts[2]) {
+			ev.Bandwidth = parts[2]
+		} else if len(parts) > 2 {
+			ev.Via = parts[2:]
+		}
+		return ev, nil
+	case "VERSION":
+		return Version{strings.TrimSpace(strings.TrimPrefix(cmd, "VERSION"))}, nil
+	case "REGISTERED":
+		var ev Registered
+		if len(parts) > 1 {
+			ev.Call = parts[1]
+		}
+		return ev, nil
+	}
+	return Unknown{cmd}, nil
+}
+
+// parseConnected parses the fields of a CONNECTED command. The callsigns are empty if VARA left
+// them out.
+func parseConnected(parts []string) Connected {
+	var ev Connected
+	if len(parts) > 1 {
+		ev.Src = parts[1]
+	}
+	if len(parts) < 3 {
+		return ev
+	}
+	ev.Dst = parts[2]
+	rest := parts[3:]
+	if n := len(rest); n > 0 {
+		if last := rest[n-1]; contains(bandwidths, last) || contains(fmBandwidths, last) {
+			ev.Bandwidth = last
+			rest = rest[:n-1]
+		}
+	}
+	if len(rest) > 0 && strings.EqualFold(rest[0], "via") {
+		ev.Via = rest[1:]
+	}
+	return ev
+}
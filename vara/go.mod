@@ -5,4 +5,5 @@ go 1.16
 require (
 	github.com/imdario/mergo v0.3.12
 	github.com/la5nta/wl2k-go v0.9.2
+	golang.org/x/net v0.0.0-20210502030024-e5908800b52b
 )
@@ -0,0 +1,194 @@
+package vara
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HeardStation describes a station heard calling CQ.
+type HeardStation struct {
+	// Callsign of the station
+	Callsign string
+	// Time the station was last heard
+	Time time.Time
+	// Freq is the frequency (Hz) the VFO was tuned to by DialURL or Scan when the station was
+	// heard; zero if unknown
+	Freq int
+	// Bandwidth of the CQ frame as reported by VARA HF, e.g. "500"; empty with the other modems
+	Bandwidth string
+	// SNR is the signal-to-noise ratio (dB) of the CQ frame, valid if HasSNR is set. VARA only
+	// reports it while CHAT mode is on.
+	SNR    int
+	HasSNR bool
+}
+
+// HeardStore persists the heard list across restarts, see SetHeardStore.
+type HeardStore interface {
+	// LoadHeard returns the stations saved last, if any.
+	LoadHeard() ([]HeardStation, error)
+	// SaveHeard replaces the saved stations.
+	SaveHeard([]HeardStation) error
+}
+
+// FileHeardStore is a HeardStore keeping the heard list as JSON in the named file.
+type FileHeardStore string
+
+// LoadHeard reads the heard list from the file. A missing file is an empty list.
+func (f FileHeardStore) LoadHeard() ([]HeardStation, error) {
+	data, err := os.ReadFile(string(f))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var heard []HeardStation
+	return heard, json.Unmarshal(data, &heard)
+}
+
+// SaveHeard writes the heard list to the file, replacing it atomically.
+func (f FileHeardStore) SaveHeard(heard []HeardStation) error {
+	data, err := json.MarshalIndent(heard, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(string(f)), filepath.Base(string(f))+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), string(f))
+}
+
+// heardStore is the persistence set up with SetHeardStore.
+type heardStore struct {
+	store  HeardStore
+	maxAge time.Duration
+	// saveMu orders saves, so the latest list is written last
+	saveMu sync.Mutex
+}
+
+// SetHeardStore restores the heard list from store, and saves it there whenever a station is
+// heard. Stations not heard within maxAge are dropped; zero keeps them forever. A nil store stops
+// persisting the list.
+func (m *Modem) SetHeardStore(store HeardStore, maxAge time.Duration) error {
+	if store == nil {
+		m.mu.Lock()
+		m.heardStore = nil
+		m.mu.Unlock()
+		return nil
+	}
+	saved, err := store.LoadHeard()
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.heardStore = &heardStore{store: store, maxAge: maxAge}
+	if m.heard == nil {
+		m.heard = make(map[string]HeardStation)
+	}
+	for _, h := range saved {
+		if cur, ok := m.heard[h.Callsign]; !ok || h.Time.After(cur.Time) {
+			m.heard[h.Callsign] = h
+		}
+	}
+	m.pruneHeard(time.Now())
+	return nil
+}
+
+// pruneHeard drops the stations not heard within the store's maxAge. The caller must hold mu.
+func (m *Modem) pruneHeard(now time.Time) {
+	if m.heardStore == nil || m.heardStore.maxAge <= 0 {
+		return
+	}
+	for call, h := range m.heard {
+		if now.Sub(h.Time) > m.heardStore.maxAge {
+			delete(m.heard, call)
+		}
+	}
+}
+
+// saveHeard writes the heard list to the store, if any.
+func (m *Modem) saveHeard() {
+	m.mu.Lock()
+	s := m.heardStore
+	m.mu.Unlock()
+	if s == nil {
+		return
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if err := s.store.SaveHeard(m.HeardStations()); err != nil {
+		m.logf("saving heard list failed: %v", err)
+	}
+}
+
+// HeardStations returns the stations heard calling CQ, most recently heard first.
+func (m *Modem) HeardStations() []HeardStation {
+	m.mu.Lock()
+	m.pruneHeard(time.Now())
+	heard := make([]HeardStation, 0, len(m.heard))
+	for _, h := range m.heard {
+		heard = append(heard, h)
+	}
+	m.mu.Unlock()
+	sort.Slice(heard, func(i, j int) bool { return heard[i].Time.After(heard[j].Time) })
+	return heard
+}
+
+// Heard returns when each station calling CQ was last heard, keyed by callsign, like the heard
+// lists of the other wl2k-go transports.
+func (m *Modem) Heard() map[string]time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneHeard(time.Now())
+	heard := make(map[string]time.Time, len(m.heard))
+	for call, h := range m.heard {
+		heard[call] = h.Time
+	}
+	return heard
+}
+
+// recordHeard adds a CQ frame, e.g. "CQFRAME LA1B 500", to the heard list.
+func (m *Modem) recordHeard(ev CQFrame) {
+	h := HeardStation{Callsign: strings.ToUpper(ev.Src), Time: time.Now()}
+	if m.scheme == "varahf" {
+		h.Bandwidth = ev.Bandwidth
+	}
+	m.mu.Lock()
+	h.Freq = m.freq
+	if m.heard == nil {
+		m.heard = make(map[string]HeardStation)
+	}
+	m.heard[h.Callsign] = h
+	m.lastHeard = h.Callsign
+	m.mu.Unlock()
+	go m.saveHeard()
+}
+
+// heardSNR attaches an S/N report outside of a session to the CQ frame it follows. The caller must
+// hold mu.
+func (m *Modem) heardSNR(snr int) {
+	h, ok := m.heard[m.lastHeard]
+	if !ok {
+		return
+	}
+	h.SNR, h.HasSNR = snr, true
+	m.heard[m.lastHeard] = h
+	m.lastHeard = ""
+	go m.saveHeard()
+}
@@ -1,19 +1,389 @@
 package vara
 
-import "net"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
 
 // Implementation for the net.Listener interface.
-// (Close method is implemented in connection.go.)
+// (Close method is implemented in vara.go.)
 
-// Accept waits for and returns the next connection to the listener.
+// Accept waits for and returns the next connection to the listener, i.e. the next session another
+// station establishes with VARA.
+//
+// VARA is told to answer connect requests (LISTEN ON) from the first call to Accept until Close,
+// except while dialing.
+//
+// While VARA reports a pending connect request, DialURL holds off with ErrChannelBusy.
 func (m *Modem) Accept() (net.Conn, error) {
-	// TODO: VARA command is "LISTEN ON"
-	return nil, errNotImplemented
+	return m.AcceptContext(context.Background())
+}
+
+// AcceptContext is like Accept, but gives up and returns ctx.Err() when ctx is done.
+func (m *Modem) AcceptContext(ctx context.Context) (net.Conn, error) {
+	closed := m.acceptClosedChan()
+	m.mu.Lock()
+	m.acceptWanted = true
+	m.mu.Unlock()
+	if err := m.resumeListen(); errors.Is(err, ErrCommandRejected) {
+		return nil, err
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		select {
+		case <-closed:
+			return nil, m.acceptClosedError()
+		default:
+		}
+		// Open the VARA TCP ports if they aren't; VARA is set to listen on connect
+		if err := m.reopen(); err != nil {
+			return nil, err
+		}
+		if err := m.openData(m.configEndpoint()); err != nil {
+			return nil, err
+		}
+
+		cmds, cancel := m.cmdSubscribe()
+		for open := true; open; {
+			timeout, changed, stop := m.acceptTimer()
+			select {
+			case conn := <-m.incoming:
+				stop()
+				cancel()
+				return conn, nil
+			case <-ctx.Done():
+				stop()
+				cancel()
+				return nil, ctx.Err()
+			case <-timeout:
+				cancel()
+				return nil, &net.OpError{Op: "accept", Net: network, Addr: m.Addr(), Err: os.ErrDeadlineExceeded}
+			case <-closed:
+				stop()
+				cancel()
+				return nil, m.acceptClosedError()
+			case <-changed:
+			case _, open = <-cmds:
+			}
+			stop()
+		}
+		// The command connection was lost; reconnect, unless a session came in just before
+		cancel()
+		select {
+		case conn := <-m.incoming:
+			return conn, nil
+		default:
+		}
+	}
+}
+
+// SetAcceptHook sets a function deciding whether to accept an incoming session from remoteCall,
+// e.g. depending on the time of day or the load. It is consulted when VARA reports the session
+// established, after the Allow and Deny lists, and the session is disconnected instead of being
+// handed to Accept if it returns false. VARA doesn't tell who is calling while a connect request
+// is pending, so that is the earliest point to decide.
+//
+// The hook runs while the modem processes VARA's commands, so it should return quickly and not
+// call into the modem. A nil hook accepts everyone the lists let through.
+func (m *Modem) SetAcceptHook(hook func(remoteCall string) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.acceptHook = hook
+}
+
+// Ban refuses sessions from call for d, or until Unban if d is zero, like ModemConfig.Deny does. A
+// callsign without SSID bans every SSID of it. Banning a station again replaces its ban.
+func (m *Modem) Ban(call string, d time.Duration) error {
+	if err := checkCallsign(call); err != nil {
+		return err
+	}
+	var expires time.Time
+	if d > 0 {
+		expires = time.Now().Add(d)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.bans == nil {
+		m.bans = make(map[string]time.Time)
+	}
+	m.bans[strings.ToUpper(call)] = expires
+	return nil
+}
+
+// Unban lifts the ban of call, as given to Ban.
+func (m *Modem) Unban(call string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.bans, strings.ToUpper(call))
+}
+
+// Bans returns the banned callsigns and when their bans expire; zero means never.
+func (m *Modem) Bans() map[string]time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneBans(time.Now())
+	bans := make(map[string]time.Time, len(m.bans))
+	for call, expires := range m.bans {
+		bans[call] = expires
+	}
+	return bans
+}
+
+// banned reports whether call is banned at now. The caller must hold mu.
+func (m *Modem) banned(call string, now time.Time) bool {
+	m.pruneBans(now)
+	calls := make([]string, 0, len(m.bans))
+	for c := range m.bans {
+		calls = append(calls, c)
+	}
+	return matchCallsign(calls, call)
+}
+
+// pruneBans drops the bans expired at now. The caller must hold mu.
+func (m *Modem) pruneBans(now time.Time) {
+	for call, expires := range m.bans {
+		if !expires.IsZero() && !now.Before(expires) {
+			delete(m.bans, call)
+		}
+	}
+}
+
+// acceptClosedChan returns a channel closed by the next call to Close.
+func (m *Modem) acceptClosedChan() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.acceptClosed == nil {
+		m.acceptClosed = make(chan struct{})
+	}
+	return m.acceptClosed
+}
+
+// closeAccept unblocks the Accept calls in progress and stops VARA from answering.
+func (m *Modem) closeAccept() {
+	m.mu.Lock()
+	m.acceptWanted = false
+	if m.acceptClosed != nil {
+		close(m.acceptClosed)
+		m.acceptClosed = nil
+	}
+	on := m.wantListen()
+	m.mu.Unlock()
+	if err := m.listen(on); err != nil {
+		m.logf("listen failed: %v", err)
+	}
+}
+
+func (m *Modem) acceptClosedError() error {
+	return &net.OpError{Op: "accept", Net: network, Addr: m.Addr(), Err: net.ErrClosed}
+}
+
+// SetDeadline sets the deadline for Accept, like net.TCPListener.SetDeadline: once it has passed,
+// Accept fails with an error wrapping os.ErrDeadlineExceeded. It affects an Accept that is already
+// waiting. A zero value means no deadline.
+func (m *Modem) SetDeadline(t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.acceptDeadline = t
+	if m.deadlineChanged != nil {
+		close(m.deadlineChanged)
+	}
+	m.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// acceptTimer returns a channel that fires at the Accept deadline (nil if none), a channel closed
+// when the deadline changes and a function to release the timer.
+func (m *Modem) acceptTimer() (timeout <-chan time.Time, changed <-chan struct{}, stop func()) {
+	m.mu.Lock()
+	if m.deadlineChanged == nil {
+		m.deadlineChanged = make(chan struct{})
+	}
+	deadline, changed := m.acceptDeadline, m.deadlineChanged
+	m.mu.Unlock()
+	if deadline.IsZero() {
+		return nil, changed, func() {}
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	return timer.C, changed, func() { timer.Stop() }
+}
+
+// Monitor transmits: VARA answers connect requests from other stations while monitoring, as it
+// can't decode CQ frames without listening for them, so Monitor requires
+// ModemConfig.MonitorTransmits and otherwise fails with ErrMonitorTransmits.
+//
+// Monitor keeps VARA listening until ctx is done, without ever accepting a session: other stations'
+// CQ frames are reported to CQNotifications, and the sessions VARA establishes with them are
+// disconnected right away (unless Accept is in use as well).
+//
+// Monitor blocks, so run it in its own goroutine. It returns ctx.Err(), or an error if VARA can't
+// be reached.
+func (m *Modem) Monitor(ctx context.Context) error {
+	m.mu.Lock()
+	if !m.config.MonitorTransmits {
+		m.mu.Unlock()
+		return ErrMonitorTransmits
+	}
+	if m.monitoring {
+		m.mu.Unlock()
+		return errors.New("already monitoring")
+	}
+	m.monitoring = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.monitoring = false
+		on := m.wantListen()
+		m.mu.Unlock()
+		if err := m.listen(on); err != nil {
+			m.logf("listen failed: %v", err)
+		}
+	}()
+
+	for {
+		if m.cmdOpen() {
+			if err := m.resumeListen(); errors.Is(err, ErrCommandRejected) {
+				return err
+			}
+		} else if err := m.reopen(); err != nil {
+			return err
+		}
+		cmds, cancel := m.cmdSubscribe()
+		for open := true; open; {
+			select {
+			case <-ctx.Done():
+				cancel()
+				return ctx.Err()
+			case _, open = <-cmds:
+			}
+		}
+		// A session's end tears down the command connection; pick it up again
+		cancel()
+	}
+}
+
+// Scan steps the VFO through freqs (Hz), listening on each for dwell, until ctx is done. It pauses
+// on a frequency while the channel is busy, a connect request is pending or an incoming session is
+// in progress, and stays for another dwell once the activity ends. This lets a gateway monitor
+// several channels with one modem.
+//
+// VARA listens for the whole scan, so it answers connect requests. As with Monitor, sessions other
+// stations establish with us are disconnected right away unless Accept is in use as well, but VARA
+// has transmitted by then.
+//
+// Scan blocks, so run it in its own goroutine. Don't dial while scanning.
+func (m *Modem) Scan(ctx context.Context, freqs []int, dwell time.Duration) error {
+	if len(freqs) == 0 {
+		return errors.New("no frequencies to scan")
+	}
+	m.mu.Lock()
+	vfo := m.vfo
+	if vfo == nil {
+		m.mu.Unlock()
+		return errors.New("scanning requires a VFO, see SetVFO")
+	}
+	if m.scanning {
+		m.mu.Unlock()
+		return errors.New("already scanning")
+	}
+	m.scanning = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.scanning = false
+		on := m.wantListen()
+		m.mu.Unlock()
+		if err := m.listen(on); err != nil {
+			m.logf("listen failed: %v", err)
+		}
+	}()
+
+	var cmds <-chan Event
+	cancel := func() {}
+	defer func() { cancel() }()
+	subscribe := func() error {
+		cancel()
+		if m.cmdOpen() {
+			if err := m.resumeListen(); errors.Is(err, ErrCommandRejected) {
+				return err
+			}
+		} else if err := m.reopen(); err != nil {
+			return err
+		}
+		cmds, cancel = m.cmdSubscribe()
+		return nil
+	}
+	if err := subscribe(); err != nil {
+		return err
+	}
+
+	var busy, pending, linked bool
+	for i := 0; ; i = (i + 1) % len(freqs) {
+		if err := vfo.SetFreq(freqs[i]); err != nil {
+			return fmt.Errorf("QSY to %d Hz failed: %w", freqs[i], err)
+		}
+		m.debugf("scanning %d Hz", freqs[i])
+		m.mu.Lock()
+		m.freq = freqs[i]
+		m.mu.Unlock()
+		busy = false
+		next := time.NewTimer(dwell)
+	listen:
+		for {
+			select {
+			case <-ctx.Done():
+				next.Stop()
+				return ctx.Err()
+			case ev, ok := <-cmds:
+				if !ok {
+					// A session's end tears down the command connection; pick it up again
+					if err := subscribe(); err != nil {
+						next.Stop()
+						return err
+					}
+					pending, linked = false, false
+					continue
+				}
+				wasHeld := busy || pending || linked
+				switch ev := ev.(type) {
+				case Busy:
+					busy = ev.On
+				case Pending:
+					pending = true
+				case CancelPending:
+					pending = false
+				case Connected:
+					pending, linked = false, true
+				case Disconnected:
+					pending, linked = false, false
+				}
+				if held := busy || pending || linked; held != wasHeld {
+					// Stay put while held, then for another dwell
+					next.Stop()
+					if !held {
+						next = time.NewTimer(dwell)
+					}
+				}
+			case <-next.C:
+				if busy || pending || linked {
+					// Fired just before it was stopped
+					continue
+				}
+				break listen
+			}
+		}
+	}
 }
 
 // Addr returns the listener's network address.
 func (m *Modem) Addr() net.Addr {
-	return Addr{m.myCall}
+	return Addr{m.callsigns()[0]}
 }
 
 type Addr struct{ string }
@@ -0,0 +1,61 @@
+package vara
+
+import (
+	"log"
+	"os"
+)
+
+// Logger receives the modem's log output.
+type Logger interface {
+	// Printf logs noteworthy events, such as unexpected commands from VARA.
+	Printf(format string, v ...interface{})
+	// Debugf logs detailed diagnostics, such as every command exchanged with VARA.
+	Debugf(format string, v ...interface{})
+}
+
+var debug bool
+
+func init() {
+	debug = os.Getenv("VARA_DEBUG") != ""
+}
+
+// stdLogger is the default Logger. It writes to the standard logger, and only logs debug output if
+// env var VARA_DEBUG exists.
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+func (stdLogger) Debugf(format string, v ...interface{}) {
+	if debug {
+		log.Printf("[VARA] "+format, v...)
+	}
+}
+
+// loggerValue wraps a Logger so it can be stored in an atomic.Value.
+type loggerValue struct{ Logger }
+
+// SetLogger routes the modem's log output to l instead of the standard logger. If nil, the default
+// is restored.
+func (m *Modem) SetLogger(l Logger) {
+	if l == nil {
+		l = stdLogger{}
+	}
+	m.logger.Store(loggerValue{l})
+}
+
+func (m *Modem) log() Logger {
+	if l, ok := m.logger.Load().(loggerValue); ok {
+		return l.Logger
+	}
+	return stdLogger{}
+}
+
+func (m *Modem) logf(format string, v ...interface{}) {
+	m.log().Printf(format, v...)
+}
+
+func (m *Modem) debugf(format string, v ...interface{}) {
+	m.log().Debugf(format, v...)
+}
@@ -0,0 +1,105 @@
+package vara
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// multiRetryDelay is how long MultiListener waits before listening again on a modem whose Accept
+// failed, e.g. because VARA isn't running.
+const multiRetryDelay = 10 * time.Second
+
+// MultiListener is a net.Listener accepting sessions from several modems, e.g. VARA HF on 40m and
+// VARA FM on 2m. Accept returns whichever modem's incoming session arrives first.
+type MultiListener struct {
+	modems []*Modem
+	conns  chan net.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	startOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewMultiListener returns a listener accepting sessions from all of modems. The modems start
+// listening with the first call to Accept.
+func NewMultiListener(modems ...*Modem) *MultiListener {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &MultiListener{
+		modems: modems,
+		conns:  make(chan net.Conn),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Accept waits for and returns the next session established with any of the modems. Once the
+// listener is closed, it fails with an error wrapping net.ErrClosed.
+func (l *MultiListener) Accept() (net.Conn, error) {
+	l.startOnce.Do(func() {
+		for _, m := range l.modems {
+			l.wg.Add(1)
+			go l.accept(m)
+		}
+	})
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, &net.OpError{Op: "accept", Net: network, Addr: l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+// accept hands m's incoming sessions to Accept until the listener is closed. A modem that fails is
+// retried after multiRetryDelay, so one VARA being down doesn't stop the others.
+func (l *MultiListener) accept(m *Modem) {
+	defer l.wg.Done()
+	for {
+		conn, err := m.AcceptContext(l.ctx)
+		switch {
+		case l.ctx.Err() != nil:
+			if conn != nil {
+				_ = conn.Close()
+			}
+			return
+		case errors.Is(err, net.ErrClosed):
+			return
+		case err != nil:
+			m.logf("Accept failed, retrying in %v: %v", multiRetryDelay, err)
+			select {
+			case <-time.After(multiRetryDelay):
+				continue
+			case <-l.ctx.Done():
+				return
+			}
+		}
+		select {
+		case l.conns <- conn:
+		case <-l.ctx.Done():
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+// Close stops the modems from accepting sessions, unblocking any Accept. Like closing a
+// net.TCPListener, it leaves the sessions already accepted alone.
+func (l *MultiListener) Close() error {
+	l.cancel()
+	for _, m := range l.modems {
+		m.closeAccept()
+	}
+	l.wg.Wait()
+	return nil
+}
+
+// Addr returns the address of the first modem, or an empty address if there is none.
+func (l *MultiListener) Addr() net.Addr {
+	if len(l.modems) == 0 {
+		return Addr{}
+	}
+	return l.modems[0].Addr()
+}
@@ -0,0 +1,63 @@
+package vara
+
+import (
+	"time"
+
+	"github.com/la5nta/wl2k-go/transport"
+)
+
+// Option configures a Modem in NewModem, on top of the ModemConfig.
+type Option func(*Modem)
+
+// WithHost sets the host on the network which is hosting VARA.
+func WithHost(host string) Option {
+	return func(m *Modem) { m.config.Host = host }
+}
+
+// WithPorts sets VARA's command and data TCP ports. A zero dataPort means cmdPort + 1.
+func WithPorts(cmdPort, dataPort int) Option {
+	return func(m *Modem) { m.config.CmdPort, m.config.DataPort = cmdPort, dataPort }
+}
+
+// WithTimeouts sets how long DialURL waits for the remote station to answer and how long Close
+// waits for VARA to confirm a graceful disconnect. Zero leaves the respective default.
+func WithTimeouts(connect, disconnect time.Duration) Option {
+	return func(m *Modem) { m.config.ConnectTimeout, m.config.DisconnectTimeout = connect, disconnect }
+}
+
+// WithRetry sets how DialURL retries failed connect attempts.
+func WithRetry(retry RetryPolicy) Option {
+	return func(m *Modem) { m.config.Retry = retry }
+}
+
+// WithAliases sets additional callsigns VARA answers to.
+func WithAliases(aliases ...string) Option {
+	return func(m *Modem) { m.config.Aliases = aliases }
+}
+
+// WithCallsignLists sets the callsigns allowed and denied to connect, see ModemConfig.Allow and
+// ModemConfig.Deny.
+func WithCallsignLists(allow, deny []string) Option {
+	return func(m *Modem) { m.config.Allow, m.config.Deny = allow, deny }
+}
+
+// WithAcceptHook sets the function deciding whether to accept incoming sessions, see
+// SetAcceptHook.
+func WithAcceptHook(hook func(remoteCall string) bool) Option {
+	return func(m *Modem) { m.acceptHook = hook }
+}
+
+// WithLogger routes the modem's log output to l, see SetLogger.
+func WithLogger(l Logger) Option {
+	return func(m *Modem) { m.SetLogger(l) }
+}
+
+// WithPTTController sets the PTTController controlled by the modem, see SetPTT.
+func WithPTTController(ptt transport.PTTController) Option {
+	return func(m *Modem) { m.rig = ptt }
+}
+
+// WithVFO sets the VFO tuned by DialURL and Scan, see SetVFO.
+func WithVFO(vfo VFO) Option {
+	return func(m *Modem) { m.vfo = vfo }
+}
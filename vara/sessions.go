@@ -0,0 +1,76 @@
+package vara
+
+import "time"
+
+// SessionInfo describes an established session.
+type SessionInfo struct {
+	// LocalCall is the callsign of this station used in the session, which is one of the aliases
+	// if the remote station called one; RemoteCall is the remote station's
+	LocalCall  string
+	RemoteCall string
+	// Inbound is set if the remote station initiated the session
+	Inbound bool
+	// Bandwidth of the session as reported by VARA, see Bandwidth on the connection
+	Bandwidth string
+	// Mode is the session type selected for an outgoing VARA HF or VARA SAT session. VARA doesn't
+	// report it for incoming sessions, so it is only meaningful for outgoing ones.
+	Mode SessionMode
+	// Started is when the link was established
+	Started time.Time
+}
+
+// SessionRecord describes a finished session, for usage reports.
+type SessionRecord struct {
+	SessionInfo
+	// Duration is how long the session lasted
+	Duration time.Duration
+	// BytesWritten and BytesRead are the payload bytes sent and received
+	BytesWritten int64
+	BytesRead    int64
+	// Quality summarizes the S/N reports during the session, see LinkQuality on the connection
+	Quality LinkQuality
+}
+
+// Sessions returns the sessions finished since the modem was created or ResetSessions was last
+// called, oldest first.
+func (m *Modem) Sessions() []SessionRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]SessionRecord(nil), m.sessions...)
+}
+
+// ResetSessions returns the sessions like Sessions does, and starts over with an empty list. This
+// suits periodic usage reports, as no session falls between two of them.
+func (m *Modem) ResetSessions() []SessionRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := m.sessions
+	m.sessions = nil
+	return sessions
+}
+
+// endSession records the end of the current session, if any.
+func (m *Modem) endSession() {
+	m.mu.Lock()
+	conn := m.current
+	if conn != nil {
+		conn.freezeLink()
+	}
+	m.current = nil
+	m.mu.Unlock()
+	if conn == nil {
+		return
+	}
+	conn.end()
+	stats := conn.Stats()
+	record := SessionRecord{
+		SessionInfo:  conn.info,
+		Duration:     stats.Duration,
+		BytesWritten: stats.BytesWritten,
+		BytesRead:    stats.BytesRead,
+		Quality:      conn.LinkQuality(),
+	}
+	m.mu.Lock()
+	m.sessions = append(m.sessions, record)
+	m.mu.Unlock()
+}
@@ -1,9 +1,14 @@
 package vara
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/la5nta/wl2k-go/transport"
 )
@@ -11,96 +16,587 @@ import (
 // Implementations for various wl2k-go/transport interfaces.
 
 func (m *Modem) DialURL(url *transport.URL) (net.Conn, error) {
+	return m.DialURLContext(context.Background(), url)
+}
+
+// DialURLContext is like DialURL, but aborts the connect attempt and returns ctx.Err() if ctx is
+// done before the link is established.
+//
+// Only one dial may be in progress at a time, as they would interleave commands on the single
+// command connection; overlapping calls fail with ErrDialInProgress.
+func (m *Modem) DialURLContext(ctx context.Context, url *transport.URL) (net.Conn, error) {
 	if url.Scheme != m.scheme {
 		return nil, transport.ErrUnsupportedScheme
 	}
-
-	// Open the VARA command TCP port if it isn't
-	if m.cmdConn == nil {
-		if err := m.start(); err != nil {
+	if _, err := urlBandwidth(url); err != nil {
+		return nil, err
+	}
+	if _, err := m.urlSessionMode(url); err != nil {
+		return nil, err
+	}
+	if _, err := m.urlEndpoint(url); err != nil {
+		return nil, err
+	}
+	if _, err := m.urlSource(url); err != nil {
+		return nil, err
+	}
+	if _, err := urlFreq(url); err != nil {
+		return nil, err
+	}
+	for _, call := range append([]string{url.Target}, urlDigis(url)...) {
+		if err := checkCallsign(call); err != nil {
 			return nil, err
 		}
 	}
+	if len(urlDigis(url)) > 0 && m.scheme != "varafm" {
+		return nil, errors.New("digipeaters are only supported by VARA FM")
+	}
+	if url.Params.Get("bw") != "" && m.scheme != "varahf" {
+		return nil, errors.New("bandwidth selection is only supported by VARA HF")
+	}
+
+	// Claim the command connection for this dial, and allow AbortDial from here on
+	abort := make(chan struct{})
+	m.mu.Lock()
+	if m.abortDial != nil {
+		m.mu.Unlock()
+		return nil, ErrDialInProgress
+	}
+	m.abortDial = abort
+	m.dialTarget = ""
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.abortDial = nil
+		m.mu.Unlock()
+		_ = m.resumeListen()
+	}()
+
+	retry := m.currentConfig().Retry
+	delay := retry.Backoff
+	for attempt := 1; ; attempt++ {
+		conn, err := m.dial(ctx, url, abort, attempt)
+		if err == nil || !retryable(err) || attempt >= retry.MaxAttempts {
+			return conn, err
+		}
+
+		wait := retry.jitter(delay)
+		m.debugf("connect attempt %d failed (%v), retrying in %v", attempt, err, wait)
+		m.dialEvent(DialRetrying, url.Target, attempt)
+		select {
+		case <-abort:
+			return nil, ErrDialAborted
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+		if retry.MaxBackoff > 0 && delay > retry.MaxBackoff {
+			delay = retry.MaxBackoff
+		}
+	}
+}
+
+// DialFailover dials each of urls in turn, e.g. a list of RMS gateways in order of preference,
+// until one connects. It returns the connection and the URL that succeeded.
+//
+// A target failing for any reason moves on to the next, except when the dial is cancelled or
+// aborted, or VARA itself is unusable; then DialFailover gives up at once. If all targets fail, the
+// returned error wraps the last target's error.
+func (m *Modem) DialFailover(ctx context.Context, urls []*transport.URL) (net.Conn, *transport.URL, error) {
+	if len(urls) == 0 {
+		return nil, nil, errors.New("no targets to dial")
+	}
+	var err error
+	for _, url := range urls {
+		var conn net.Conn
+		conn, err = m.DialURLContext(ctx, url)
+		if err == nil {
+			return conn, url, nil
+		}
+		m.debugf("dialing %s failed: %v", url.Target, err)
+		if ctx.Err() != nil || errors.Is(err, ErrDialAborted) || errors.Is(err, ErrDialInProgress) ||
+			errors.Is(err, ErrModemUnavailable) || errors.Is(err, ErrSoundcardMissing) {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, fmt.Errorf("all %d targets failed, last: %w", len(urls), err)
+}
+
+// retryable reports whether a connect attempt failing with err is worth retrying.
+func retryable(err error) bool {
+	return errors.Is(err, ErrRemoteRefused) || errors.Is(err, ErrConnectTimeout) ||
+		errors.Is(err, ErrChannelBusy)
+}
+
+// dial makes a single connect attempt.
+func (m *Modem) dial(ctx context.Context, url *transport.URL, abort <-chan struct{}, attempt int) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	config := m.currentConfig()
+
+	// Switch modem program if the URL asks for a different one
+	ep, err := m.urlEndpoint(url)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.switchEndpoint(ep); err != nil {
+		return nil, err
+	}
 
 	// Open the VARA data TCP port if it isn't
-	if m.dataConn == nil {
-		var err error
-		if m.dataConn, err = m.connectTCP("data", m.config.DataPort); err != nil {
+	if err := m.openData(ep); err != nil {
+		return nil, err
+	}
+
+	// Make sure VARA is fit to transmit
+	if config.HealthCheck > 0 {
+		if err := m.healthCheck(ctx, config.HealthCheck); err != nil {
 			return nil, err
 		}
 	}
 
-	// Select public
-	if err := m.writeCmd(fmt.Sprintf("PUBLIC ON")); err != nil {
+	// Set MYCALL, in case the callsigns changed since setup
+	if err := m.writeMyCall(); err != nil {
 		return nil, err
 	}
 
-	// CWID enable
-	if m.scheme == "varahf" {
-		if err := m.writeCmd(fmt.Sprintf("CWID ON")); err != nil {
+	// Set bandwidth from the URL
+	if err := m.setBandwidth(url); err != nil {
+		return nil, err
+	}
+
+	if m.scheme != "varafm" {
+		// VARA HF and VARA SAT only - Winlink or P2P?
+		mode, err := m.urlSessionMode(url)
+		if err != nil {
 			return nil, err
 		}
+		if err := m.sendCommand(mode.command()); err != nil {
+			return nil, err
+		}
+		m.mu.Lock()
+		m.session = mode
+		m.mu.Unlock()
 	}
 
-	// Set compression
-	if err := m.writeCmd(fmt.Sprintf("COMPRESSION TEXT")); err != nil {
+	// QSY to the requested frequency
+	if err := m.qsy(url); err != nil {
 		return nil, err
 	}
 
-	// Set MYCALL
-	if err := m.writeCmd(fmt.Sprintf("MYCALL %s", m.myCall)); err != nil {
-		return nil, err
+	// Don't transmit over others
+	if config.BusyWait > 0 {
+		if err := m.waitClear(ctx, abort, config.BusyWait, config.BusyLockout); err != nil {
+			return nil, err
+		}
+	} else if config.BusyLockout > 0 && m.busyWithin(config.BusyLockout) {
+		return nil, ErrChannelBusy
 	}
 
-	// Set bandwidth from the URL
-	if err := m.setBandwidth(url); err != nil {
+	// Don't call over a station connecting to us
+	m.mu.Lock()
+	pending := m.pending
+	m.mu.Unlock()
+	if pending {
+		return nil, ErrChannelBusy
+	}
+
+	// Don't answer others while calling
+	if err := m.listen(false); err != nil {
 		return nil, err
 	}
 
-	// Listen on
-	if err := m.writeCmd(fmt.Sprintf("LISTEN ON")); err != nil {
+	// Forget any state change left over from a previous session
+	select {
+	case <-m.connectChange:
+	default:
+	}
+
+	// Start connecting, keeping an eye out for why it might fail
+	cmds, unsubscribe := m.cmdSubscribe()
+	defer unsubscribe()
+	source, err := m.urlSource(url)
+	if err != nil {
 		return nil, err
 	}
+	m.mu.Lock()
+	m.fromCall, m.toCall = source, url.Target
+	m.dialTarget = url.Target
+	m.mu.Unlock()
+	connect := fmt.Sprintf("CONNECT %s %s", source, url.Target)
+	if digis := urlDigis(url); len(digis) > 0 {
+		connect += " via " + strings.Join(digis, " ")
+	}
+	reply := make(chan Reply, 1)
+	if err := m.writeCmdReply(connect, reply); err != nil {
+		return nil, err
+	}
+	m.dialEvent(DialCalling, url.Target, attempt)
 
-	if m.scheme == "varahf" {
-		// VaraHF only - Winlink or P2P?
-		p2p := url.Params.Get("p2p") == "true"
-		if p2p {
-			if err := m.writeCmd(fmt.Sprintf("P2P SESSION")); err != nil {
+	// Block until connected, reporting progress along the way
+	wait := ctx
+	if config.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		wait, cancel = context.WithTimeout(ctx, config.ConnectTimeout)
+		defer cancel()
+	}
+	var reason string
+	handle := func(ev Event) {
+		switch ev {
+		case PTT{On: true}:
+			m.dialEvent(DialTransmitting, url.Target, attempt)
+		case Pending{}:
+			m.dialEvent(DialPending, url.Target, attempt)
+		}
+		if r := refusalReason(ev); r != "" {
+			reason = r
+		}
+	}
+	for linked := false; !linked; {
+		select {
+		case <-abort:
+			m.abortConnect()
+			return nil, ErrDialAborted
+		case <-wait.Done():
+			m.abortConnect()
+			if err := ctx.Err(); err != nil {
 				return nil, err
 			}
-		} else {
-			if err := m.writeCmd(fmt.Sprintf("WINLINK SESSION")); err != nil {
-				return nil, err
+			return nil, ErrConnectTimeout
+		case r, ok := <-reply:
+			if ok && !r.OK {
+				return nil, &CommandError{Cmd: connect}
+			}
+			reply = nil
+		case ev, ok := <-cmds:
+			if !ok {
+				// The modem is gone; connectChange tells the rest
+				cmds = nil
+				break
+			}
+			handle(ev)
+		case state := <-m.connectChange:
+			// Catch up on what VARA said before the state change
+			drain(cmds, handle)
+			if state != connected {
+				m.mu.Lock()
+				m.dataConn = nil
+				m.mu.Unlock()
+				return nil, refusedError(reason)
 			}
+			linked = true
 		}
 	}
 
-	// Start connecting
-	m.toCall = url.Target
-	if err := m.writeCmd(fmt.Sprintf("CONNECT %s %s", m.myCall, m.toCall)); err != nil {
-		return nil, err
+	// Hand the VARA data TCP port to the client code
+	m.mu.Lock()
+	dataConn := m.dataConn
+	m.mu.Unlock()
+	if dataConn == nil {
+		return nil, ErrRemoteRefused
 	}
+	m.dialEvent(DialConnected, url.Target, attempt)
+	return newDataConn(m, dataConn, false), nil
+}
 
-	// Block until connected
-	if <-m.connectChange != connected {
-		m.dataConn = nil
-		return nil, errors.New("connection failed")
+// refusalReason returns the reason for a failed connect attempt implied by ev, if any. Only
+// documented commands count; anything else VARA says during the attempt explains nothing.
+func refusalReason(ev Event) string {
+	if ev == (MissingSoundcard{}) {
+		return "MISSING SOUNDCARD"
 	}
+	return ""
+}
 
-	// Hand the VARA data TCP port to the client code
-	return &varaDataConn{*m.dataConn, *m}, nil
+// drain passes the commands already queued in cmds to handle.
+func drain(cmds <-chan Event, handle func(Event)) {
+	for {
+		select {
+		case ev, ok := <-cmds:
+			if !ok {
+				return
+			}
+			handle(ev)
+		default:
+			return
+		}
+	}
 }
 
-func (m *Modem) setBandwidth(url *transport.URL) error {
-	bw := url.Params.Get("bw")
-	if bw == "" {
+// refusedError returns the error for a connect attempt VARA gave up on, with the reason it gave,
+// if any.
+func refusedError(reason string) error {
+	if reason == "" {
+		return ErrRemoteRefused
+	}
+	return &RemoteRefusedError{Reason: reason}
+}
+
+// waitClear waits up to max for the channel to have been clear for holdOff.
+func (m *Modem) waitClear(ctx context.Context, abort <-chan struct{}, max, holdOff time.Duration) error {
+	cmds, cancel := m.cmdSubscribe()
+	defer cancel()
+	giveUp := time.After(max)
+	for {
+		var recheck <-chan time.Time
+		switch d := m.clearIn(holdOff); {
+		case d == 0:
+			return nil
+		case d > 0:
+			recheck = time.After(d)
+		}
+		select {
+		case <-abort:
+			return ErrDialAborted
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-giveUp:
+			return ErrChannelBusy
+		case _, ok := <-cmds:
+			if !ok {
+				return ErrModemClosed
+			}
+		case <-recheck:
+		}
+	}
+}
+
+// DialStage is a step of a connect attempt.
+type DialStage int
+
+const (
+	// DialCalling means VARA was asked to call the target station.
+	DialCalling DialStage = iota
+	// DialTransmitting means VARA keyed the transmitter to call.
+	DialTransmitting
+	// DialPending means VARA detected a connect request being answered.
+	DialPending
+	// DialConnected means the link is established.
+	DialConnected
+	// DialRetrying means the attempt failed and another will be made, see ModemConfig.Retry.
+	DialRetrying
+)
+
+func (s DialStage) String() string {
+	switch s {
+	case DialCalling:
+		return "calling"
+	case DialTransmitting:
+		return "transmitting"
+	case DialPending:
+		return "link pending"
+	case DialConnected:
+		return "connected"
+	case DialRetrying:
+		return "retrying"
+	}
+	return fmt.Sprintf("DialStage(%d)", int(s))
+}
+
+// DialEvent reports the progress of a dial.
+type DialEvent struct {
+	Stage DialStage
+	// Target is the station being called
+	Target string
+	// Attempt is the connect attempt the event belongs to, starting at 1
+	Attempt int
+}
+
+// DialProgress returns a channel receiving progress events of every dial, e.g. to show "Calling
+// LA1B..." while DialURL blocks.
+//
+// Events are dropped if the channel is not drained.
+func (m *Modem) DialProgress() <-chan DialEvent {
+	return m.dialEvents
+}
+
+func (m *Modem) dialEvent(stage DialStage, target string, attempt int) {
+	select {
+	case m.dialEvents <- DialEvent{Stage: stage, Target: target, Attempt: attempt}:
+	default:
+		m.debugf("dial event dropped: %v", stage)
+	}
+}
+
+// AbortDial stops the connect attempt in progress, if any, making it return ErrDialAborted. The
+// modem remains usable.
+func (m *Modem) AbortDial() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.abortDial == nil {
+		return
+	}
+	select {
+	case <-m.abortDial:
+		// Already aborted
+	default:
+		close(m.abortDial)
+	}
+}
+
+// abortConnect tells VARA to stop calling.
+func (m *Modem) abortConnect() {
+	if err := m.writeCmd("ABORT"); err != nil {
+		m.debugf("abort failed: %v", err)
+	}
+}
+
+// urlSessionMode returns the session mode for a dial: the configured one, unless overridden by the
+// URL's p2p parameter.
+func (m *Modem) urlSessionMode(url *transport.URL) (SessionMode, error) {
+	p2p := url.Params.Get("p2p")
+	if p2p == "" {
+		return m.currentConfig().SessionMode, nil
+	}
+	on, err := strconv.ParseBool(p2p)
+	if err != nil {
+		return 0, fmt.Errorf("invalid p2p parameter %q", p2p)
+	}
+	if on {
+		return P2PSession, nil
+	}
+	return WinlinkSession, nil
+}
+
+// urlEndpoint returns the VARA modem program to dial through: the configured one, unless the URL
+// names another host, optionally with its command port. As with VARA itself, the data port is the
+// command port + 1.
+func (m *Modem) urlEndpoint(url *transport.URL) (endpoint, error) {
+	ep := m.configEndpoint()
+	if url.Host == "" {
+		return ep, nil
+	}
+	host, port, err := net.SplitHostPort(url.Host)
+	if err != nil {
+		// No port given
+		ep.host = url.Host
+		return ep, nil
+	}
+	cmdPort, err := strconv.Atoi(port)
+	if err != nil || cmdPort < 1 || cmdPort > 65534 {
+		return ep, fmt.Errorf("invalid VARA command port %q", port)
+	}
+	ep.host, ep.cmdPort, ep.dataPort = host, cmdPort, cmdPort+1
+	return ep, nil
+}
+
+// switchEndpoint opens the command connection to ep like ensureOpen, closing one to another VARA
+// first.
+func (m *Modem) switchEndpoint(ep endpoint) error {
+	m.reopenMu.Lock()
+	defer m.reopenMu.Unlock()
+	m.mu.Lock()
+	switching := m.cmdConn != nil && m.endpoint != ep
+	m.mu.Unlock()
+	if switching {
+		m.disconnectModem()
+	}
+	if m.cmdOpen() {
 		return nil
 	}
-	if !contains(bandwidths, bw) {
-		return errors.New(fmt.Sprintf("bandwidth %s not supported", bw))
+	return m.start(ep)
+}
+
+// urlSource returns the callsign to connect from: the primary callsign, unless the URL's user
+// names one of the aliases, e.g. varafm://TAC1@/LA1B.
+func (m *Modem) urlSource(url *transport.URL) (string, error) {
+	calls := m.callsigns()
+	if url.User == nil || url.User.Username() == "" {
+		return calls[0], nil
 	}
-	return m.writeCmd(fmt.Sprintf("BW%s", bw))
+	src := url.User.Username()
+	for _, call := range calls {
+		if strings.EqualFold(call, src) {
+			return call, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not one of the modem's callsigns", src)
+}
+
+// urlFreq returns the frequency in Hz requested by the URL's freq parameter, given in kHz like
+// elsewhere in Pat (e.g. freq=7101.5); zero if none.
+func urlFreq(url *transport.URL) (int, error) {
+	freq := url.Params.Get("freq")
+	if freq == "" {
+		return 0, nil
+	}
+	khz, err := strconv.ParseFloat(freq, 64)
+	if err != nil || khz <= 0 {
+		return 0, fmt.Errorf("invalid freq parameter %q", freq)
+	}
+	return int(math.Round(khz * 1000)), nil
+}
+
+// qsy tunes the VFO to the frequency requested by the URL, if any. Without a VFO the parameter is
+// left to the application.
+func (m *Modem) qsy(url *transport.URL) error {
+	freq, err := urlFreq(url)
+	if err != nil || freq == 0 {
+		return err
+	}
+	m.mu.Lock()
+	vfo := m.vfo
+	m.mu.Unlock()
+	if vfo == nil {
+		m.debugf("no VFO set, not changing frequency to %d Hz", freq)
+		return nil
+	}
+	if err := vfo.SetFreq(freq); err != nil {
+		return fmt.Errorf("QSY to %d Hz failed: %w", freq, err)
+	}
+
+	// Busy reports so far were about the old frequency
+	m.mu.Lock()
+	m.busy = false
+	m.lastBusy = time.Time{}
+	m.freq = freq
+	m.mu.Unlock()
+	return nil
+}
+
+// urlDigis returns the digipeater path requested by the URL, given either as path elements before
+// the target or as a comma separated via parameter.
+func urlDigis(url *transport.URL) []string {
+	var digis []string
+	via := strings.Split(url.Params.Get("via"), ",")
+	for _, d := range append(append([]string(nil), url.Digis...), via...) {
+		if d = strings.TrimSpace(d); d != "" {
+			digis = append(digis, d)
+		}
+	}
+	return digis
+}
+
+// urlBandwidth returns the bandwidth requested by the URL's bw parameter, if any.
+func urlBandwidth(url *transport.URL) (string, error) {
+	bw := url.Params.Get("bw")
+	if bw != "" && !contains(bandwidths, bw) {
+		return "", fmt.Errorf("bandwidth %s not supported", bw)
+	}
+	return bw, nil
+}
+
+func (m *Modem) setBandwidth(url *transport.URL) error {
+	bw, err := urlBandwidth(url)
+	if err != nil || bw == "" {
+		return err
+	}
+	if err := m.sendCommand(fmt.Sprintf("BW%s", bw)); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.bandwidth = bw
+	m.mu.Unlock()
+	return nil
+}
+
+// selectedBandwidth returns the bandwidth last selected with BW, if any.
+func (m *Modem) selectedBandwidth() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bandwidth
 }
 
 func contains(c []string, s string) bool {
@@ -114,13 +610,58 @@ func contains(c []string, s string) bool {
 
 // Busy returns true if the channel is not clear.
 func (m *Modem) Busy() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.busy
 }
 
+// WaitNotBusy blocks until the channel is clear. It returns immediately if the channel is not busy,
+// ctx.Err() if ctx is done first, or ErrModemClosed if the modem is torn down while waiting.
+func (m *Modem) WaitNotBusy(ctx context.Context) error {
+	cmds, cancel := m.cmdSubscribe()
+	defer cancel()
+	if !m.Busy() {
+		return nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-cmds:
+			if !ok {
+				return ErrModemClosed
+			}
+			if ev == (Busy{On: false}) {
+				return nil
+			}
+		}
+	}
+}
+
+// VFO tunes a transceiver, e.g. a hamlib.VFO.
+type VFO interface {
+	// SetFreq tunes to freq Hz.
+	SetFreq(freq int) error
+}
+
+// SetVFO sets the VFO DialURL tunes before keying up when the URL has a freq parameter. If nil
+// (the default), the parameter is ignored.
+//
+// It is safe to call at any time.
+func (m *Modem) SetVFO(vfo VFO) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.vfo = vfo
+}
+
 // SetPTT injects the PTTController (probably hooked to a transceiver) that should be controlled by
 // the modem.
 //
 // If nil, the PTT request from the TNC is ignored. VOX may still work.
+//
+// It is safe to call at any time; subsequent PTT requests go to the latest controller.
 func (m *Modem) SetPTT(ptt transport.PTTController) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.rig = ptt
 }
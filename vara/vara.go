@@ -1,13 +1,20 @@
 package vara
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
+	"math/rand"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/imdario/mergo"
@@ -16,36 +23,373 @@ import (
 
 const network = "vara"
 
-var errNotImplemented = errors.New("not implemented")
+var (
+	// ErrModemClosed means the command connection to VARA went away, e.g. because the modem was
+	// closed, while waiting on it.
+	ErrModemClosed = errors.New("modem closed")
+	// ErrModemClosedRemotely means the VARA program closed the command connection in an orderly
+	// fashion, e.g. because it was shut down.
+	ErrModemClosedRemotely = errors.New("VARA closed the command connection")
+	// ErrModemReset means the command connection to VARA was reset, e.g. because it crashed.
+	ErrModemReset = errors.New("command connection to VARA was reset")
+	// ErrConnectTimeout means the remote station did not answer within ModemConfig.ConnectTimeout.
+	ErrConnectTimeout = errors.New("timeout waiting for the remote station to answer")
+	// ErrDialAborted means the connect attempt was stopped with AbortDial.
+	ErrDialAborted = errors.New("dial aborted")
+	// ErrChannelBusy means a connect attempt was refused because the channel is or was recently
+	// busy, see ModemConfig.BusyLockout.
+	ErrChannelBusy = errors.New("channel busy")
+	// ErrSoundcardMissing means VARA reported that its soundcard driver crashed. VARA can't
+	// transmit until the computer is restarted.
+	ErrSoundcardMissing = errors.New("VARA lost its soundcard")
+	// ErrInvalidConfig is matched by the *ConfigError NewModem returns for a bad ModemConfig.
+	ErrInvalidConfig = errors.New("invalid modem config")
+	// ErrDialInProgress means DialURL was called while another connect attempt was in progress.
+	ErrDialInProgress = errors.New("another dial is in progress")
+	// ErrModemUnavailable means the VARA program could not be reached over TCP, e.g. because it is
+	// not running or Host/CmdPort is wrong.
+	ErrModemUnavailable = errors.New("VARA unavailable")
+	// ErrRemoteRefused means VARA gave up on the link before it was established: the remote station
+	// did not answer or refused the connection.
+	ErrRemoteRefused = errors.New("remote station did not accept the connection")
+	// ErrLinkStalled means VARA made no progress sending its TX buffer for
+	// ModemConfig.StallTimeout, so the link was aborted.
+	ErrLinkStalled = errors.New("link stalled")
+	// ErrHungUp means this station ended the session on its own, because it reached
+	// ModemConfig.MaxSessionDuration or IdleTimeout.
+	ErrHungUp = errors.New("session ended by this station")
+	// ErrCommandRejected means VARA answered WRONG to a command, e.g. a bandwidth or callsign it
+	// doesn't support.
+	ErrCommandRejected = errors.New("command rejected by VARA")
+	// ErrMonitorTransmits means Monitor was called without ModemConfig.MonitorTransmits, which
+	// acknowledges that VARA transmits while monitoring.
+	ErrMonitorTransmits = errors.New("monitoring makes VARA transmit; set MonitorTransmits to allow it")
+)
+
+// unavailableError wraps the reason VARA could not be reached, matching ErrModemUnavailable while
+// keeping the underlying network error accessible to errors.Is/As.
+type unavailableError struct{ err error }
+
+func (e unavailableError) Error() string        { return e.err.Error() }
+func (e unavailableError) Unwrap() error        { return e.err }
+func (e unavailableError) Is(target error) bool { return target == ErrModemUnavailable }
+
+// ConfigError describes a ModemConfig field NewModem can't work with. It matches ErrInvalidConfig.
+type ConfigError struct {
+	// Field is the name of the offending ModemConfig field
+	Field string
+	// Reason explains what is wrong with it
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%v: %s %s", ErrInvalidConfig, e.Field, e.Reason)
+}
+
+func (e *ConfigError) Is(target error) bool { return target == ErrInvalidConfig }
+
+// RemoteRefusedError is returned by DialURL when a connect attempt failed after VARA lost its
+// soundcard, the only failure VARA reports a reason for. It matches ErrRemoteRefused.
+//
+// VARA's protocol doesn't tell why a remote station refused the link: a station that doesn't answer
+// and one that refuses both end in a plain DISCONNECTED, for which DialURL returns ErrRemoteRefused
+// itself.
+type RemoteRefusedError struct {
+	// Reason is the command VARA sent, i.e. "MISSING SOUNDCARD"
+	Reason string
+}
+
+func (e *RemoteRefusedError) Error() string        { return ErrRemoteRefused.Error() + ": " + e.Reason }
+func (e *RemoteRefusedError) Is(target error) bool { return target == ErrRemoteRefused }
+
+// CommandError is returned when VARA answers WRONG to a command an operation depends on. It matches
+// ErrCommandRejected.
+type CommandError struct {
+	// Cmd is the rejected command, e.g. "BW2300"
+	Cmd string
+}
+
+func (e *CommandError) Error() string        { return ErrCommandRejected.Error() + ": " + e.Cmd }
+func (e *CommandError) Is(target error) bool { return target == ErrCommandRejected }
 
 // ModemConfig defines configuration options for connecting with the VARA modem program.
 type ModemConfig struct {
 	// Host on the network which is hosting VARA; defaults to `localhost`
 	Host string
-	// CmdPort is the TCP port on which to reach VARA; defaults to 8300
+	// CmdPort is the TCP port on which to reach VARA; defaults to 8300. VARA HF and VARA FM both
+	// default to 8300, so move one of them to other ports to run both on the same host.
 	CmdPort int
-	// DataPort is the TCP port on which to exchange over-the-air payloads with VARA;
-	// defaults to 8301
+	// DataPort is the TCP port on which to exchange over-the-air payloads with VARA; defaults to
+	// CmdPort + 1, like in VARA
 	DataPort int
+	// Aliases are additional callsigns VARA answers to besides the modem's own, e.g. a tactical or
+	// club callsign; at most four. They can be changed later with SetCallsigns.
+	Aliases []string
+	// DisconnectTimeout is how long Close waits for VARA to confirm a graceful disconnect before
+	// aborting the link; defaults to 60 seconds
+	DisconnectTimeout time.Duration
+	// IDInterval is how often IDText is sent over the air during a session; zero (the default)
+	// disables periodic identification.
+	//
+	// The ID text is inserted into the data stream between writes, so the remote application
+	// receives it as payload. Only enable this with applications that tolerate it.
+	IDInterval time.Duration
+	// IDText is the identification sent every IDInterval, e.g. "DE N0CALL"
+	IDText string
+	// KeepAliveInterval makes a session send KeepAliveText whenever no data has been read or written
+	// for this long, so the remote application doesn't drop an interactive session that is idle;
+	// zero (the default) disables it. Like the ID text, the remote application receives it as
+	// payload. Keepalives don't count as activity for IdleTimeout.
+	KeepAliveInterval time.Duration
+	// KeepAliveText is the payload sent by the keepalive, e.g. "\r"; required with
+	// KeepAliveInterval
+	KeepAliveText string
+	// SessionMode selects Winlink or P2P session timing for outgoing connections; defaults to
+	// WinlinkSession
+	SessionMode SessionMode
+	// Retry controls whether and how DialURL retries a connect attempt the remote station didn't
+	// answer; by default it doesn't
+	Retry RetryPolicy
+	// BusyLockout makes DialURL refuse to transmit with ErrChannelBusy while VARA reports the
+	// channel busy, or did so within this long; zero (the default) disables the lockout
+	BusyLockout time.Duration
+	// BusyWait makes DialURL wait up to this long for the channel to clear (and stay clear for
+	// BusyLockout) before transmitting, failing with ErrChannelBusy if it doesn't; zero (the
+	// default) doesn't wait
+	BusyWait time.Duration
+	// ConnectTimeout is how long DialURL waits for the remote station to answer before giving up
+	// with ErrConnectTimeout; zero (the default) leaves it to VARA's own retries
+	ConnectTimeout time.Duration
+	// TxThrottleFactor controls how much data Write lets queue up in VARA's TX buffer: a write of n
+	// bytes blocks while the buffer holds more than TxThrottleFactor*n bytes. Higher values keep
+	// the link busier at the cost of a longer wait when closing. Defaults to 14 for VARA FM, whose
+	// links are fast, and 7 otherwise; a negative value disables throttling.
+	TxThrottleFactor int
+	// BufferTimeout is how long Write, Flush and CloseWrite wait for VARA to report progress
+	// draining its TX buffer before failing; defaults to one minute. Slow HF links with deep
+	// interleaving may need more.
+	BufferTimeout time.Duration
+	// TxBufferTarget makes Write throttle adaptively instead: it measures how fast VARA drains its
+	// TX buffer and lets it hold about this much airtime, e.g. 10 seconds, which keeps the link
+	// busy without making Close wait long. TxThrottleFactor applies until the rate is known. Zero
+	// (the default) disables adaptive throttling.
+	TxBufferTarget time.Duration
+	// WriteChunkSize makes Write hand larger writes to VARA in chunks of at most this many bytes,
+	// each throttled on its own, so VARA's BUFFER reports and thus TxBufferLen and the flush
+	// progress follow a large payload more closely; zero (the default) doesn't split writes
+	WriteChunkSize int
+	// HealthCheck makes DialURL check that VARA is sane before keying up: it must answer a
+	// VERSION request and accept MYCALL within this long, and not have reported a missing
+	// soundcard. Zero (the default) skips the check.
+	HealthCheck time.Duration
+	// Allow lists the only callsigns Accept lets connect; empty (the default) allows everyone not
+	// denied. An entry without SSID matches every SSID of the callsign.
+	Allow []string
+	// RateLimit refuses stations connecting more often than it allows; by default it doesn't
+	RateLimit RateLimit
+	// ListenHoldOff makes the modem wait for the channel to be clear this long before letting VARA
+	// answer connect requests, when it starts listening and after each session, so a gateway doesn't
+	// transmit over others; zero (the default) doesn't wait
+	ListenHoldOff time.Duration
+	// MonitorTransmits allows Monitor, acknowledging that VARA keys the transmitter while
+	// monitoring: it answers other stations' connect requests before Monitor can hang up on them.
+	// VARA has no way to listen for CQ frames without answering. By default Monitor fails with
+	// ErrMonitorTransmits.
+	MonitorTransmits bool
+	// MaxSessionDuration disconnects sessions lasting longer than this, so a stuck station can't
+	// monopolize a gateway; zero (the default) doesn't limit them
+	MaxSessionDuration time.Duration
+	// IdleTimeout disconnects sessions in which no data has been read or written for this long, so
+	// a forgotten session doesn't tie up a shared frequency; zero (the default) doesn't. It can be
+	// changed per session with SetIdleTimeout.
+	IdleTimeout time.Duration
+	// StallTimeout aborts the link when VARA's TX buffer holds data but hasn't shrunk for this
+	// long, e.g. because the remote station went silent without disconnecting; pending and later
+	// writes then fail with ErrLinkStalled. Zero (the default) disables it.
+	StallTimeout time.Duration
+	// AcceptQueueTimeout is how long an incoming session waits for a call to Accept, e.g. while the
+	// application is still busy with the previous one, before it is disconnected; defaults to 30
+	// seconds
+	AcceptQueueTimeout time.Duration
+	// Deny lists callsigns whose incoming sessions are disconnected right away instead of being
+	// handed to Accept. It takes precedence over Allow, and entries match like Allow's. See Modem.Ban
+	// for bans that expire.
+	Deny []string
+}
+
+// SessionMode selects the VARA retry cycle used for a session (VARA HF and VARA SAT only).
+type SessionMode int
+
+const (
+	// WinlinkSession uses the retry cycle required to connect with Winlink RMS gateways.
+	WinlinkSession SessionMode = iota
+	// P2PSession uses a longer retry cycle for peer-to-peer connections.
+	P2PSession
+)
+
+// RetryPolicy controls how failed connect attempts are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of connect attempts; zero or one disables retrying
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled for each further retry; defaults to 5
+	// seconds
+	Backoff time.Duration
+	// MaxBackoff caps the delay between attempts; zero means no cap
+	MaxBackoff time.Duration
+	// Jitter randomly varies each delay by up to this fraction of it (0-1), so stations retrying
+	// on the same channel spread out
+	Jitter float64
+}
+
+// RateLimit limits how often a station may connect, to protect a shared channel from clients stuck
+// reconnecting in a loop.
+type RateLimit struct {
+	// MaxSessions is the number of sessions a callsign may establish within Window; zero disables
+	// the limit
+	MaxSessions int
+	// Window is the period over which sessions are counted
+	Window time.Duration
+}
+
+func (p RetryPolicy) jitter(d time.Duration) time.Duration {
+	if p.Jitter <= 0 {
+		return d
+	}
+	return d + time.Duration(p.Jitter*(2*rand.Float64()-1)*float64(d))
+}
+
+func (s SessionMode) command() string {
+	if s == P2PSession {
+		return "P2P SESSION"
+	}
+	return "WINLINK SESSION"
 }
 
 var defaultConfig = ModemConfig{
-	Host:     "localhost",
-	CmdPort:  8300,
-	DataPort: 8301,
+	Host:               "localhost",
+	CmdPort:            8300,
+	DataPort:           8301,
+	DisconnectTimeout:  60 * time.Second,
+	BufferTimeout:      time.Minute,
+	Retry:              RetryPolicy{Backoff: 5 * time.Second},
+	AcceptQueueTimeout: 30 * time.Second,
 }
 
+// txReconcileInterval is how often a session checks its TX buffer count against VARA's reports.
+var txReconcileInterval = 5 * time.Second
+
+// readFromChunkSize is how much ReadFrom writes at a time, unless ModemConfig.WriteChunkSize is
+// set.
+const readFromChunkSize = 4096
+
+// drainTimeout is how long Read waits for data still on its way from VARA once the link is gone.
+const drainTimeout = 250 * time.Millisecond
+
+// versionTimeout is how long Version waits for VARA to answer.
+const versionTimeout = 10 * time.Second
+
+// cmdTimeout is how long sendCommand waits for VARA to acknowledge a command.
+const cmdTimeout = 10 * time.Second
+
 type Modem struct {
 	scheme        string
-	myCall        string
+	myCall        string   // guarded by mu, see callsigns
+	aliases       []string // guarded by mu
 	config        ModemConfig
-	cmdConn       *net.TCPConn
-	dataConn      *net.TCPConn
+	fromCall      string // source callsign of the current session
 	toCall        string
-	busy          bool
+	bandwidth     string      // last selected with BW (VARA HF), empty keeps VARA's own; guarded by mu
+	session       SessionMode // last selected with WINLINK/P2P SESSION (VARA HF and VARA SAT)
 	connectChange chan connectedState
-	lastState     connectedState
-	rig           transport.PTTController
+	cq            chan string
+	dialEvents    chan DialEvent
+	warnings      chan string
+	incoming      chan *varaDataConn // inbound sessions for Accept
+	logger        atomic.Value       // loggerValue
+	cmdMu         sync.Mutex         // keeps the writes to cmdConn in the order of replies
+	reopenMu      sync.Mutex         // held by Reconfigure and while opening cmdConn, see ensureOpen
+
+	mu        sync.Mutex // protects the fields below
+	cmdConn   *net.TCPConn
+	dataConn  *net.TCPConn
+	endpoint  endpoint      // where cmdConn is connected
+	listening chan struct{} // closed when cmdListen stops
+	lastState connectedState
+	busy      bool
+	lastBusy  time.Time // when the channel was last reported busy
+	rig       transport.PTTController
+	vfo       VFO
+	// subscribers receive a copy of every command from VARA; nil while cmdListen isn't running
+	subscribers map[chan Event]struct{}
+	// replies has an entry for each command VARA hasn't answered with OK or WRONG yet, in the
+	// order they were sent: the channel to send the answer to, or nil if nobody waits for it
+	replies []chan Reply
+	// closeWatchers are told why cmdListen stopped
+	closeWatchers []chan error
+	// lastErr is the most recent error seen by cmdListen
+	lastErr error
+	// heard holds the stations heard calling CQ by callsign, lastHeard the one heard last;
+	// heardStore persists them
+	heard      map[string]HeardStation
+	lastHeard  string
+	heardStore *heardStore
+	// freq is the frequency (Hz) the VFO was last tuned to, zero if unknown
+	freq int
+	// snr is the most recent S/N report of the current session, valid if hasSNR is set
+	snr    int
+	hasSNR bool
+	// quality summarizes the S/N reports of the current session
+	quality LinkQuality
+	// txBuffer is the number of bytes queued in VARA's TX buffer: the last BUFFER report
+	// (txReported) plus what was written since. lastWrite is when data was last written.
+	txBuffer   int
+	txReported int
+	lastWrite  time.Time
+	// txRate is the rate (bytes/s) VARA was measured draining its TX buffer in this session, zero
+	// if unknown; bufferAt is when VARA last reported a non-empty buffer
+	txRate   float64
+	bufferAt time.Time
+	// txProgress is when VARA's TX buffer last shrank or started filling
+	txProgress time.Time
+	// abortDial is closed by AbortDial to stop the connect attempt in progress, if any
+	abortDial chan struct{}
+	// acceptDeadline is the listener deadline set with SetDeadline; deadlineChanged is closed when
+	// it changes
+	acceptDeadline  time.Time
+	deadlineChanged chan struct{}
+	// acceptWanted is set while the modem is used as a listener, i.e. from Accept until Close;
+	// monitoring is set during Monitor, scanning during Scan; listenOn is the LISTEN state last
+	// sent to VARA
+	acceptWanted bool
+	monitoring   bool
+	scanning     bool
+	listenOn     bool
+	// current is the session in progress, sessions the ones finished, see Sessions
+	current  *varaDataConn
+	sessions []SessionRecord
+	// dialTarget is the station called by the dial in progress
+	dialTarget string
+	// bans maps banned callsigns to when their ban expires, zero for never
+	bans map[string]time.Time
+	// inboundLog holds the recent session times of each calling station, for the rate limit
+	inboundLog map[string][]time.Time
+	// acceptHook decides whether to accept an incoming session, see SetAcceptHook
+	acceptHook func(remoteCall string) bool
+	// acceptClosed is closed by Close to unblock Accept, then replaced so the modem can listen again
+	acceptClosed chan struct{}
+	// pending is set while VARA reports an incoming connect request
+	pending bool
+	// soundcardMissing is set when VARA reports MISSING SOUNDCARD
+	soundcardMissing bool
+	// registeredTo is the callsign VARA reported being registered to, if any
+	registeredTo string
+	// linkRegistered tells whether the current session runs at full speed, valid if
+	// hasLinkRegistered is set
+	linkRegistered    bool
+	hasLinkRegistered bool
+	// linkBandwidth is the bandwidth of the current session as reported by VARA, e.g. "2300"
+	// (VARA HF) or "WIDE" (VARA FM); empty if not reported
+	linkBandwidth string
 }
 
 type connectedState int
@@ -55,57 +399,446 @@ const (
 	disconnected
 )
 
+// schemes are the network names this package can handle, one per VARA modem program. varasat is
+// VARA SAT, for satellites such as QO-100; it behaves like VARA HF without bandwidth selection.
+var schemes = []string{"varahf", "varafm", "varasat"}
+
+// bandwidths are the VARA HF bandwidths. VARA FM's bandwidth (WIDE or NARROW) is set in the
+// modem program and can't be selected per connection.
 var bandwidths = []string{"500", "2300", "2750"}
-var debug bool
 
-func init() {
-	debug = os.Getenv("VARA_DEBUG") != ""
-}
+// fmBandwidths are the bandwidths VARA FM reports when a link is established.
+var fmBandwidths = []string{"WIDE", "NARROW"}
+
+// txThrottleFactors are the default TxThrottleFactor per scheme.
+var txThrottleFactors = map[string]int{"varahf": 7, "varafm": 14, "varasat": 7}
+
+// maxCallsigns is the number of callsigns VARA accepts in the MYCALL command.
+const maxCallsigns = 5
 
 func Bandwidths() []string {
 	return bandwidths
 }
 
-// NewModem initializes configuration for a new VARA modem client stub.
-func NewModem(scheme string, myCall string, config ModemConfig) (*Modem, error) {
-	// Back-fill empty config values with defaults
-	if err := mergo.Merge(&config, defaultConfig); err != nil {
-		return nil, err
+// NewModem initializes configuration for a new VARA modem client stub. Options are applied on top
+// of config.
+func NewModem(scheme string, myCall string, config ModemConfig, opts ...Option) (*Modem, error) {
+	if !contains(schemes, scheme) {
+		return nil, fmt.Errorf("%w: %s", transport.ErrUnsupportedScheme, scheme)
 	}
-	return &Modem{
+	m := &Modem{
 		scheme:        scheme,
-		myCall:        myCall,
 		config:        config,
-		busy:          false,
 		connectChange: make(chan connectedState, 1),
+		cq:            make(chan string, 16),
+		dialEvents:    make(chan DialEvent, 16),
+		warnings:      make(chan string, 16),
+		incoming:      make(chan *varaDataConn, 1),
 		lastState:     disconnected,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if err := m.config.prepare(); err != nil {
+		return nil, err
+	}
+	m.session = m.config.SessionMode
+	if err := m.SetCallsigns(append([]string{myCall}, m.config.Aliases...)); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// prepare back-fills empty config values with defaults and validates the result.
+func (c *ModemConfig) prepare() error {
+	if c.DataPort == 0 && c.CmdPort != 0 {
+		c.DataPort = c.CmdPort + 1
+	}
+	if err := mergo.Merge(c, defaultConfig); err != nil {
+		return err
+	}
+	return c.validate()
+}
+
+// Reconfigure replaces the modem's configuration, e.g. to switch to another VARA instance. It
+// disconnects from the current VARA program, and reconnects using the new configuration if it
+// was connected. Callsigns, the PTT controller, VFO, logger and notification channels are kept;
+// the aliases are replaced by config.Aliases.
+//
+// It fails with ErrDialInProgress while dialing, and refuses to interrupt a session.
+func (m *Modem) Reconfigure(config ModemConfig) error {
+	if err := config.prepare(); err != nil {
+		return err
+	}
+
+	// Keep dials out meanwhile
+	m.mu.Lock()
+	if m.abortDial != nil {
+		m.mu.Unlock()
+		return ErrDialInProgress
+	}
+	if m.lastState == connected {
+		m.mu.Unlock()
+		return errors.New("can't reconfigure during a session")
+	}
+	m.abortDial = make(chan struct{})
+	reconnect := m.cmdConn != nil
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.abortDial = nil
+		m.mu.Unlock()
+		// Setup kept VARA from answering meanwhile
+		_ = m.resumeListen()
+	}()
+
+	if err := m.SetCallsigns(append(m.callsigns()[:1], config.Aliases...)); err != nil {
+		return err
+	}
+	// Listeners losing the command connection wait for the new one rather than reopening the old
+	m.reopenMu.Lock()
+	defer m.reopenMu.Unlock()
+	m.disconnectModem()
+	m.mu.Lock()
+	m.config = config
+	m.session = config.SessionMode
+	m.mu.Unlock()
+	if reconnect {
+		return m.start(m.configEndpoint())
+	}
+	return nil
+}
+
+// reopen opens the command connection for a listener that lost it, unless that happened already.
+// It waits for a Reconfigure in progress, so the listener picks up the new VARA program.
+func (m *Modem) reopen() error {
+	return m.ensureOpen(m.configEndpoint())
+}
+
+// ensureOpen opens the command connection to ep if it isn't open. Opening is serialized, so
+// callers racing to open it don't connect to VARA twice.
+func (m *Modem) ensureOpen(ep endpoint) error {
+	m.reopenMu.Lock()
+	defer m.reopenMu.Unlock()
+	if m.cmdOpen() {
+		return nil
+	}
+	return m.start(ep)
+}
+
+// validate reports the first problem with a defaults-filled config, if any.
+func (c ModemConfig) validate() error {
+	switch {
+	case strings.TrimSpace(c.Host) == "":
+		return &ConfigError{"Host", "is empty"}
+	case c.CmdPort < 1 || c.CmdPort > 65535:
+		return &ConfigError{"CmdPort", fmt.Sprintf("%d is not a valid TCP port", c.CmdPort)}
+	case c.DataPort < 1 || c.DataPort > 65535:
+		return &ConfigError{"DataPort", fmt.Sprintf("%d is not a valid TCP port", c.DataPort)}
+	case c.CmdPort == c.DataPort:
+		return &ConfigError{"DataPort", "must differ from CmdPort"}
+	}
+	durations := []struct {
+		field string
+		d     time.Duration
+	}{
+		{"DisconnectTimeout", c.DisconnectTimeout},
+		{"IDInterval", c.IDInterval},
+		{"KeepAliveInterval", c.KeepAliveInterval},
+		{"BusyLockout", c.BusyLockout},
+		{"BusyWait", c.BusyWait},
+		{"ConnectTimeout", c.ConnectTimeout},
+		{"BufferTimeout", c.BufferTimeout},
+		{"TxBufferTarget", c.TxBufferTarget},
+		{"HealthCheck", c.HealthCheck},
+		{"AcceptQueueTimeout", c.AcceptQueueTimeout},
+		{"MaxSessionDuration", c.MaxSessionDuration},
+		{"IdleTimeout", c.IdleTimeout},
+		{"StallTimeout", c.StallTimeout},
+		{"ListenHoldOff", c.ListenHoldOff},
+		{"RateLimit.Window", c.RateLimit.Window},
+		{"Retry.Backoff", c.Retry.Backoff},
+		{"Retry.MaxBackoff", c.Retry.MaxBackoff},
+	}
+	for _, d := range durations {
+		if d.d < 0 {
+			return &ConfigError{d.field, "is negative"}
+		}
+	}
+	if c.Retry.Jitter < 0 || c.Retry.Jitter > 1 {
+		return &ConfigError{"Retry.Jitter", "must be between 0 and 1"}
+	}
+	if c.KeepAliveInterval > 0 && c.KeepAliveText == "" {
+		return &ConfigError{"KeepAliveText", "is required with KeepAliveInterval"}
+	}
+	if c.WriteChunkSize < 0 {
+		return &ConfigError{"WriteChunkSize", "is negative"}
+	}
+	if c.RateLimit.MaxSessions < 0 {
+		return &ConfigError{"RateLimit.MaxSessions", "is negative"}
+	}
+	if c.RateLimit.MaxSessions > 0 && c.RateLimit.Window == 0 {
+		return &ConfigError{"RateLimit.Window", "must be set to limit sessions"}
+	}
+	lists := []struct {
+		field string
+		calls []string
+	}{
+		{"Allow", c.Allow},
+		{"Deny", c.Deny},
+	}
+	for _, l := range lists {
+		for _, call := range l.calls {
+			if err := checkCallsign(call); err != nil {
+				return &ConfigError{l.field, err.Error()}
+			}
+		}
+	}
+	return nil
+}
+
+// admits reports whether the Allow and Deny lists let call connect.
+func (c ModemConfig) admits(call string) bool {
+	if matchCallsign(c.Deny, call) {
+		return false
+	}
+	return len(c.Allow) == 0 || matchCallsign(c.Allow, call)
+}
+
+// matchCallsign reports whether call is in calls, where an entry without SSID matches every SSID
+// of the callsign.
+func matchCallsign(calls []string, call string) bool {
+	call = strings.ToUpper(call)
+	base := strings.SplitN(call, "-", 2)[0]
+	for _, c := range calls {
+		c = strings.ToUpper(c)
+		if c == call || c == base {
+			return true
+		}
+	}
+	return false
+}
+
+// endpoint is the network location of a VARA modem program.
+type endpoint struct {
+	host     string
+	cmdPort  int
+	dataPort int
+}
+
+// currentConfig returns a snapshot of the configuration, which Reconfigure may replace.
+func (m *Modem) currentConfig() ModemConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.config
+}
+
+func (m *Modem) configEndpoint() endpoint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return endpoint{m.config.Host, m.config.CmdPort, m.config.DataPort}
 }
 
 // Start establishes TCP connections with the VARA modem program. This must be called before
 // sending commands to the modem.
-func (m *Modem) start() error {
+func (m *Modem) start(ep endpoint) error {
 	// Open command port TCP connection
-	var err error
-	m.cmdConn, err = m.connectTCP("command", m.config.CmdPort)
+	cmdConn, err := m.connectTCP("command", ep.host, ep.cmdPort)
 	if err != nil {
 		return err
 	}
 
 	// channel is not busy until Vara tells otherwise
+	listening := make(chan struct{})
+	m.mu.Lock()
+	m.cmdConn = cmdConn
+	m.endpoint = ep
+	m.listening = listening
 	m.busy = false
+	m.subscribers = make(map[chan Event]struct{})
+	m.replies = nil
+	m.lastErr = nil
+	m.soundcardMissing = false
+	m.registeredTo = ""
+	m.pending = false
+	m.mu.Unlock()
 
 	// Start listening for incoming VARA commands
-	go m.cmdListen()
+	go func() {
+		defer close(listening)
+		m.cmdListen(cmdConn)
+	}()
+	return m.setup()
+}
+
+// setup configures a freshly connected VARA the way this modem last left it, so a restarted VARA
+// program carries on without intervention.
+func (m *Modem) setup() error {
+	cmds := []string{"PUBLIC ON"}
+	if m.scheme == "varahf" {
+		cmds = append(cmds, "CWID ON")
+	}
+	cmds = append(cmds, "COMPRESSION TEXT", m.myCallCmd())
+	if bw := m.selectedBandwidth(); m.scheme == "varahf" && bw != "" {
+		cmds = append(cmds, "BW"+bw)
+	}
+	m.mu.Lock()
+	m.listenOn = m.wantListen()
+	holdOff := m.listenOn && m.config.ListenHoldOff > 0
+	if holdOff {
+		m.listenOn = false
+	}
+	cmds = append(cmds, listenCmd(m.listenOn))
+	if m.scheme != "varafm" {
+		cmds = append(cmds, m.session.command())
+	}
+	m.mu.Unlock()
+	for _, cmd := range cmds {
+		if err := m.sendCommand(cmd); err != nil {
+			return err
+		}
+	}
+	if holdOff {
+		go m.listenWhenClear()
+	}
+	return nil
+}
+
+// listen tells VARA whether to answer incoming connect requests, unless it already does so. It
+// does nothing during a session, which VARA would drop on a LISTEN command; VARA doesn't answer
+// others then anyway, and the state is set up afresh after the session.
+func (m *Modem) listen(on bool) error {
+	m.mu.Lock()
+	if m.cmdConn == nil || m.listenOn == on || m.lastState == connected {
+		m.mu.Unlock()
+		return nil
+	}
+	m.listenOn = on
+	m.mu.Unlock()
+	if err := m.sendCommand(listenCmd(on)); err != nil {
+		m.mu.Lock()
+		m.listenOn = !on
+		m.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// resumeListen turns listening back on after a dial, if the modem is used as a listener and no
+// session is in progress. It returns the error of turning it on right away, if any.
+func (m *Modem) resumeListen() error {
+	m.mu.Lock()
+	resume := m.wantListen() && m.lastState != connected
+	holdOff := m.config.ListenHoldOff > 0 && !m.listenOn && m.cmdConn != nil
+	m.mu.Unlock()
+	switch {
+	case !resume:
+	case holdOff:
+		go m.listenWhenClear()
+	default:
+		if err := m.listen(true); err != nil {
+			m.logf("listen failed: %v", err)
+			return err
+		}
+	}
 	return nil
 }
 
+// listenWhenClear turns listening on once the channel has been clear for ListenHoldOff, so VARA
+// doesn't answer over others. It gives up if the command connection closes meanwhile.
+func (m *Modem) listenWhenClear() {
+	cmds, cancel := m.cmdSubscribe()
+	defer cancel()
+	since := time.Now()
+	for {
+		m.mu.Lock()
+		busy, holdOff := m.busy, m.config.ListenHoldOff
+		if m.lastBusy.After(since) {
+			since = m.lastBusy
+		}
+		m.mu.Unlock()
+		var recheck <-chan time.Time
+		if !busy {
+			d := holdOff - time.Since(since)
+			if d <= 0 {
+				break
+			}
+			recheck = time.After(d)
+		}
+		select {
+		case _, ok := <-cmds:
+			if !ok {
+				return
+			}
+		case <-recheck:
+		}
+	}
+	m.mu.Lock()
+	resume := m.wantListen() && m.lastState != connected
+	m.mu.Unlock()
+	if !resume {
+		return
+	}
+	m.debugf("channel clear, listening")
+	if err := m.listen(true); err != nil {
+		m.logf("listen failed: %v", err)
+	}
+}
+
+// wantListen reports whether VARA should answer connect requests. The caller must hold mu.
+func (m *Modem) wantListen() bool {
+	return (m.acceptWanted || m.monitoring || m.scanning) && m.abortDial == nil
+}
+
+func listenCmd(on bool) string {
+	if on {
+		return "LISTEN ON"
+	}
+	return "LISTEN OFF"
+}
+
+// disconnectModem closes the TCP connections to VARA and waits for the command listener to stop.
+func (m *Modem) disconnectModem() {
+	m.mu.Lock()
+	dataConn, cmdConn, listening := m.dataConn, m.cmdConn, m.listening
+	m.dataConn, m.cmdConn = nil, nil
+	m.mu.Unlock()
+	m.disconnectTCP("data", dataConn)
+	m.disconnectTCP("cmd", cmdConn)
+	if listening != nil {
+		<-listening
+	}
+}
+
 // Close closes the RF and then the TCP connections to the VARA modem. Blocks until finished.
+//
+// As net.Listener.Close, it also makes any blocked Accept return an error wrapping net.ErrClosed.
 func (m *Modem) Close() error {
-	// Block until VARA modem acks disconnect
-	if m.lastState == connected {
+	m.closeAccept()
+	return m.closeSession(m.currentConfig().DisconnectTimeout)
+}
+
+// closeSession ends the current session, if any, waiting up to timeout for a graceful disconnect
+// before aborting it. A zero timeout aborts it right away.
+func (m *Modem) closeSession(timeout time.Duration) error {
+	if m.state() == connected && timeout == 0 {
+		// Drop the link and whatever VARA has queued
+		if err := m.writeCmd("ABORT"); err != nil {
+			return err
+		}
+	} else if m.state() == connected {
+		// Block until VARA modem acks disconnect
+		// An accepted session leaves its connect unread; don't mistake it for the reply
+		select {
+		case res := <-m.connectChange:
+			if res == disconnected {
+				m.setConnectChange(res)
+			}
+		default:
+		}
+
 		// Send DISCONNECT command
-		if m.cmdConn != nil {
+		if m.cmdOpen() {
 			if err := m.writeCmd("DISCONNECT"); err != nil {
 				return err
 			}
@@ -114,12 +847,12 @@ func (m *Modem) Close() error {
 		select {
 		case res := <-m.connectChange:
 			if res != disconnected {
-				log.Println("Disconnect failed, aborting!")
+				m.logf("Disconnect failed, aborting!")
 				if err := m.writeCmd("ABORT"); err != nil {
 					return err
 				}
 			}
-		case <-time.After(time.Second * 60):
+		case <-time.After(timeout):
 			if err := m.writeCmd("ABORT"); err != nil {
 				return err
 			}
@@ -127,153 +860,835 @@ func (m *Modem) Close() error {
 	}
 
 	// Make sure to stop TX (should have already happened, but this is a backup)
-	if m.rig != nil {
-		_ = m.rig.SetPTT(false)
-	}
+	m.sendPTT(false)
 
 	// Clear up internal state
-	m.toCall = ""
+	m.mu.Lock()
+	m.fromCall, m.toCall = "", ""
 	m.busy = false
+	m.mu.Unlock()
 	return nil
 }
 
-func (m *Modem) connectTCP(name string, port int) (*net.TCPConn, error) {
-	debugPrint(fmt.Sprintf("Connecting %s", name))
-	cmdAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", m.config.Host, port))
+func (m *Modem) connectTCP(name string, host string, port int) (*net.TCPConn, error) {
+	m.debugf("Connecting %s", name)
+	cmdAddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
 	if err != nil {
-		return nil, fmt.Errorf("couldn't resolve VARA %s address: %w", name, err)
+		return nil, unavailableError{fmt.Errorf("couldn't resolve VARA %s address: %w", name, err)}
 	}
 	conn, err := net.DialTCP("tcp", nil, cmdAddr)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't connect to VARA %s port: %w", name, err)
+		return nil, unavailableError{fmt.Errorf("couldn't connect to VARA %s port: %w", name, err)}
 	}
 	return conn, nil
 }
 
-func disconnectTCP(name string, port *net.TCPConn) *net.TCPConn {
+func (m *Modem) disconnectTCP(name string, port *net.TCPConn) {
 	if port == nil {
-		return nil
+		return
 	}
 	_ = port.Close()
-	debugPrint(fmt.Sprintf("disonnected %s", name))
+	m.debugf("disonnected %s", name)
+}
+
+// openData opens the VARA data TCP port if it isn't.
+func (m *Modem) openData(ep endpoint) error {
+	m.mu.Lock()
+	open := m.dataConn != nil
+	m.mu.Unlock()
+	if open {
+		return nil
+	}
+	dataConn, err := m.connectTCP("data", ep.host, ep.dataPort)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.dataConn = dataConn
+	m.mu.Unlock()
+	return nil
+}
+
+// cmdOpen reports whether the VARA command TCP port is open.
+func (m *Modem) cmdOpen() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cmdConn != nil
+}
+
+func (m *Modem) state() connectedState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastState
+}
+
+// SetCallsigns sets the callsigns VARA answers to. The first is the primary callsign, used as the
+// source of outgoing connections; the rest are aliases. VARA accepts up to five callsigns.
+func (m *Modem) SetCallsigns(calls []string) error {
+	if len(calls) == 0 {
+		return errors.New("at least one callsign is required")
+	}
+	if len(calls) > maxCallsigns {
+		return fmt.Errorf("too many callsigns: VARA accepts at most %d", maxCallsigns)
+	}
+	for _, c := range calls {
+		if err := checkCallsign(c); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	m.myCall = calls[0]
+	m.aliases = append([]string(nil), calls[1:]...)
+	m.mu.Unlock()
+	return nil
+}
+
+// callsigns returns the callsigns VARA answers to, the primary one first.
+func (m *Modem) callsigns() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{m.myCall}, m.aliases...)
+}
+
+// checkCallsign returns a descriptive error if call isn't a callsign VARA accepts: 3 to 7 letters
+// and digits, optionally followed by an SSID of 1 to 15, T or R.
+func checkCallsign(call string) error {
+	base, ssid, hasSSID := call, "", false
+	if i := strings.IndexByte(call, '-'); i >= 0 {
+		base, ssid, hasSSID = call[:i], call[i+1:], true
+	}
+	if len(base) < 3 || len(base) > 7 {
+		return fmt.Errorf("invalid callsign %q: expected 3 to 7 characters before the SSID", call)
+	}
+	for _, r := range strings.ToUpper(base) {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			return fmt.Errorf("invalid callsign %q: only letters and digits are allowed", call)
+		}
+	}
+	if !hasSSID {
+		return nil
+	}
+	switch strings.ToUpper(ssid) {
+	case "T", "R":
+		return nil
+	}
+	if n, err := strconv.Atoi(ssid); err != nil || n < 1 || n > 15 || strconv.Itoa(n) != ssid {
+		return fmt.Errorf("invalid callsign %q: SSID must be 1 to 15, T or R", call)
+	}
 	return nil
 }
 
+func (m *Modem) writeMyCall() error {
+	return m.sendCommand(m.myCallCmd())
+}
+
+func (m *Modem) myCallCmd() string {
+	return "MYCALL " + strings.Join(m.callsigns(), " ")
+}
+
 // wrapper around m.cmdConn.Write
 func (m *Modem) writeCmd(cmd string) error {
-	debugPrint(fmt.Sprintf("writing cmd: %v", cmd))
-	_, err := m.cmdConn.Write([]byte(cmd + "\r"))
-	return err
+	return m.writeCmdReply(cmd, nil)
+}
+
+// writeCmdReply writes cmd, and has VARA's answer to it (OK or WRONG) sent to reply, unless that
+// is nil.
+func (m *Modem) writeCmdReply(cmd string, reply chan Reply) error {
+	m.debugf("writing cmd: %v", cmd)
+	m.cmdMu.Lock()
+	defer m.cmdMu.Unlock()
+	m.mu.Lock()
+	cmdConn := m.cmdConn
+	if cmdConn != nil && cmd != "VERSION" {
+		// VARA answers each command in turn, with OK or WRONG except for VERSION
+		m.replies = append(m.replies, reply)
+	}
+	m.mu.Unlock()
+	if cmdConn == nil {
+		return ErrModemClosed
+	}
+	if _, err := cmdConn.Write([]byte(cmd + "\r")); err != nil {
+		m.mu.Lock()
+		m.dropReplies()
+		m.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// sendCommand writes cmd and waits for VARA to acknowledge it. It fails if VARA answers WRONG or
+// doesn't answer within cmdTimeout. It must not be called from cmdListen, which delivers the
+// answer.
+func (m *Modem) sendCommand(cmd string) error {
+	reply := make(chan Reply, 1)
+	if err := m.writeCmdReply(cmd, reply); err != nil {
+		return err
+	}
+	timer := time.NewTimer(cmdTimeout)
+	defer timer.Stop()
+	select {
+	case r, ok := <-reply:
+		if !ok {
+			return ErrModemClosed
+		}
+		if !r.OK {
+			return &CommandError{Cmd: cmd}
+		}
+		return nil
+	case <-timer.C:
+		// The answer may still come; it is then handed to the buffered reply channel
+		return fmt.Errorf("no reply to %s: %w", cmd, os.ErrDeadlineExceeded)
+	}
+}
+
+// handleReply hands VARA's answer r (OK or WRONG) to whoever waits for it. It reports whether
+// anyone did.
+func (m *Modem) handleReply(r Reply) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.replies) == 0 {
+		return false
+	}
+	reply := m.replies[0]
+	m.replies = m.replies[1:]
+	if reply == nil {
+		return false
+	}
+	reply <- r
+	return true
+}
+
+// dropReplies fails the commands waiting for an answer that won't come. The caller must hold mu.
+func (m *Modem) dropReplies() {
+	for _, reply := range m.replies {
+		if reply != nil {
+			close(reply)
+		}
+	}
+	m.replies = nil
 }
 
 // goroutine listening for incoming commands
-func (m *Modem) cmdListen() {
-	var buf = make([]byte, 1<<16)
+func (m *Modem) cmdListen(cmdConn *net.TCPConn) {
+	var reason error
+	defer func() {
+		m.closeSubscribers()
+		m.notifyModemClosed(reason)
+	}()
+	r := bufio.NewReader(cmdConn)
+	var partial string
 	for {
-		if m.cmdConn == nil {
-			// probably disconnected
-			return
-		}
-		l, err := m.cmdConn.Read(buf)
+		line, err := r.ReadString('\r')
 		if err != nil {
-			debugPrint(fmt.Sprintf("cmdListen err: %v", err))
-			if errors.Is(err, io.EOF) {
-				// VARA program killed?
+			// Keep what came of a command cut short by a transient error
+			partial += line
+			m.mu.Lock()
+			closedLocally := m.cmdConn != cmdConn
+			m.mu.Unlock()
+			if closedLocally {
 				return
 			}
-			continue
-		}
-		cmds := strings.Split(string(buf[:l]), "\r")
-		for _, c := range cmds {
-			if c == "" {
+			switch {
+			case errors.Is(err, io.EOF):
+				// VARA program shut down
+				reason = ErrModemClosedRemotely
+			case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED):
+				// VARA program killed?
+				reason = fmt.Errorf("%w: %v", ErrModemReset, err)
+			case isTimeout(err):
+				// transient; keep listening
+				m.setLastError(fmt.Errorf("reading VARA command port: %w", err))
 				continue
+			default:
+				reason = fmt.Errorf("reading VARA command port: %w", err)
 			}
-			if !m.handleCmd(c) {
-				return
-			}
+			m.setLastError(reason)
+			// The command port is gone; tear down as if VARA disconnected so waiters unblock
+			m.handleDisconnect()
+			return
+		}
+		c := strings.TrimSuffix(partial+line, "\r")
+		partial = ""
+		if c == "" {
+			continue
+		}
+		ev, ok := m.handleCmd(c)
+		if ev != nil {
+			m.publish(ev)
+		}
+		if !ok {
+			return
 		}
 	}
 }
 
-// handleCmd handles one command coming from the VARA modem. It returns true if listening should
-// continue or false if listening should stop.
-func (m *Modem) handleCmd(c string) bool {
-	debugPrint(fmt.Sprintf("got cmd: %v", c))
-	switch c {
-	case "PTT ON":
-		// VARA wants to start TX; send that to the PTTController
-		m.sendPTT(true)
-	case "PTT OFF":
-		// VARA wants to stop TX; send that to the PTTController
-		m.sendPTT(false)
-	case "BUSY ON":
-		m.busy = true
-	case "BUSY OFF":
-		m.busy = false
-	case "OK":
-		// nothing to do
-	case "IAMALIVE":
-		// nothing to do
-	case "PENDING":
+// handleCmd handles one command coming from the VARA modem. It returns the parsed command, nil if
+// it is malformed, and true if listening should continue or false if listening should stop.
+func (m *Modem) handleCmd(c string) (Event, bool) {
+	m.debugf("got cmd: %v", c)
+	ev, err := ParseEvent(c)
+	if err != nil {
+		// Malformed reports are skipped
+		m.debugf("%v", err)
+		m.setLastError(err)
+		return nil, true
+	}
+	switch ev := ev.(type) {
+	case PTT:
+		// VARA wants to start or stop TX; send that to the PTTController
+		m.sendPTT(ev.On)
+	case Busy:
+		m.setBusy(ev.On)
+	case Reply:
+		if !m.handleReply(ev) && !ev.OK {
+			m.logf("got a vara command I wasn't expecting: %v", c)
+		}
+	case IAmAlive:
 		// nothing to do
-	case "DISCONNECTED":
+	case Pending:
+		m.setPending(true)
+	case CancelPending:
+		m.setPending(false)
+	case MissingSoundcard:
+		m.logf("VARA lost its soundcard; restart the computer to recover")
+		m.mu.Lock()
+		m.soundcardMissing = true
+		m.mu.Unlock()
+	case Disconnected:
 		m.handleDisconnect()
-		return false
+		return ev, false
+	case Connected:
+		m.handleConnect(ev)
+	case Buffer:
+		m.handleBuffer(ev.N)
+	case SN:
+		m.handleSN(ev.SNR)
+	case CQFrame:
+		m.handleCQ(ev)
+	case Version:
+		// reply to Version
+	case Registered:
+		if ev.Call != "" {
+			m.logf("VARA full speed available, registered to %s", ev.Call)
+			m.mu.Lock()
+			m.registeredTo = ev.Call
+			m.mu.Unlock()
+		}
+	case LinkRegistration:
+		m.handleLinkRegistration(ev.Registered)
 	default:
-		if strings.HasPrefix(c, "CONNECTED") {
-			m.handleConnect()
-			break
-		}
-		if strings.HasPrefix(c, "BUFFER") {
-			// nothing to do
-			break
-		}
-		if strings.HasPrefix(c, "REGISTERED") {
-			parts := strings.Split(c, " ")
-			if len(parts) > 1 {
-				log.Printf("VARA full speed available, registered to %s", parts[1])
-			}
-			break
+		m.logf("got a vara command I wasn't expecting: %v", c)
+	}
+	return ev, true
+}
+
+// cmdSubscribe returns a channel receiving every command VARA sends from now on, parsed, and a
+// function to cancel the subscription. The channel is closed when the command listener stops.
+func (m *Modem) cmdSubscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 32)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.subscribers == nil {
+		// Not listening; nothing will ever arrive
+		close(ch)
+		return ch, func() {}
+	}
+	m.subscribers[ch] = struct{}{}
+	return ch, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if _, ok := m.subscribers[ch]; ok {
+			delete(m.subscribers, ch)
+			close(ch)
 		}
-		log.Printf("got a vara command I wasn't expecting: %v", c)
 	}
-	return true
+}
+
+// publish hands a command to all subscribers. Subscribers that have fallen behind miss it.
+func (m *Modem) publish(ev Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for ch := range m.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			m.debugf("subscriber full, dropped cmd: %+v", ev)
+		}
+	}
+}
+
+// closeSubscribers ends all subscriptions once the command listener stops.
+func (m *Modem) closeSubscribers() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for ch := range m.subscribers {
+		close(ch)
+	}
+	m.subscribers = nil
+	m.dropReplies()
+}
+
+// ModemClosed returns a channel that is sent the reason the command connection to VARA ends:
+// ErrModemClosedRemotely if VARA closed it cleanly, an error wrapping ErrModemReset if it was reset
+// abruptly, or nil if it was closed after VARA reported a disconnect.
+func (m *Modem) ModemClosed() <-chan error {
+	ch := make(chan error, 1)
+	m.mu.Lock()
+	m.closeWatchers = append(m.closeWatchers, ch)
+	m.mu.Unlock()
+	return ch
+}
+
+func (m *Modem) notifyModemClosed(reason error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, ch := range m.closeWatchers {
+		ch <- reason
+	}
+	m.closeWatchers = nil
+}
+
+// LastError returns the most recent error encountered while listening for VARA commands, or nil
+// if there was none since the command connection was last opened.
+func (m *Modem) LastError() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastErr
+}
+
+func (m *Modem) setLastError(err error) {
+	m.debugf("cmdListen err: %v", err)
+	m.mu.Lock()
+	m.lastErr = err
+	m.mu.Unlock()
+}
+
+func (m *Modem) setBusy(busy bool) {
+	m.mu.Lock()
+	m.busy = busy
+	m.lastBusy = time.Now()
+	m.mu.Unlock()
+}
+
+// busyWithin reports whether the channel is busy or was busy within d.
+func (m *Modem) busyWithin(d time.Duration) bool {
+	return m.clearIn(d) != 0
+}
+
+// clearIn returns how long until the channel has been clear for d: zero if it already has, or -1
+// if it is busy now.
+func (m *Modem) clearIn(d time.Duration) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case m.busy:
+		return -1
+	case m.lastBusy.IsZero():
+		return 0
+	case time.Since(m.lastBusy) < d:
+		return d - time.Since(m.lastBusy)
+	}
+	return 0
 }
 
 func (m *Modem) sendPTT(on bool) {
-	if m.rig != nil {
-		_ = m.rig.SetPTT(on)
+	m.mu.Lock()
+	rig := m.rig
+	m.mu.Unlock()
+	if rig != nil {
+		_ = rig.SetPTT(on)
+	}
+}
+
+// handleLinkRegistration records whether the current session is registered, i.e. "LINK
+// REGISTERED" or "LINK UNREGISTERED". VARA caps the speed of unregistered links.
+func (m *Modem) handleLinkRegistration(registered bool) {
+	if !registered {
+		m.warn("link is unregistered, VARA limits the speed of this session")
+	}
+	m.mu.Lock()
+	m.linkRegistered, m.hasLinkRegistered = registered, true
+	m.mu.Unlock()
+}
+
+// Registered reports whether VARA said it is registered, which is required for full speed.
+func (m *Modem) Registered() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.registeredTo != ""
+}
+
+// Warnings returns a channel receiving warnings about conditions that degrade sessions, such as
+// VARA limiting the speed of an unregistered link. Warnings are logged as well.
+//
+// Warnings are dropped if the channel is not drained.
+func (m *Modem) Warnings() <-chan string {
+	return m.warnings
+}
+
+func (m *Modem) warn(warning string) {
+	m.logf("VARA: %s", warning)
+	select {
+	case m.warnings <- warning:
+	default:
 	}
 }
 
-func (m *Modem) handleConnect() {
+// handleConnect records a link being established, e.g. "CONNECTED N0CALL LA1B 2300" (VARA HF),
+// "CONNECTED N0CALL LA1B" (VARA SAT) or "CONNECTED N0CALL LA1B via LA1D WIDE" (VARA FM).
+func (m *Modem) handleConnect(ev Connected) {
+	// A station calling us while we're calling someone else must not pass for our callee
+	m.mu.Lock()
+	stray := m.abortDial != nil && ev.Dst != "" && !strings.EqualFold(ev.Dst, m.dialTarget)
+	m.mu.Unlock()
+	if stray {
+		m.logf("refusing connection from %s while dialing", ev.Src)
+		m.hangUp()
+		return
+	}
+
+	m.mu.Lock()
+	m.hasSNR = false
+	m.quality = LinkQuality{}
+	m.txBuffer, m.txReported, m.lastWrite = 0, 0, time.Time{}
+	m.txRate, m.bufferAt, m.txProgress = 0, time.Time{}, time.Time{}
+	m.linkBandwidth = ev.Bandwidth
+	m.hasLinkRegistered = false
 	m.lastState = connected
-	m.connectChange <- connected
+	m.pending = false
+	inbound := m.abortDial == nil
+	dataConn := m.dataConn
+	m.mu.Unlock()
+	m.setConnectChange(connected)
+	if inbound {
+		m.handleInbound(ev, dataConn)
+	}
+}
+
+// handleInbound hands a session someone else initiated, e.g. "CONNECTED LA1B N0CALL 2300", to
+// Accept. Dst is the callsign the caller targeted, i.e. ours or one of our aliases.
+func (m *Modem) handleInbound(ev Connected, dataConn *net.TCPConn) {
+	m.mu.Lock()
+	monitoring := (m.monitoring || m.scanning) && !m.acceptWanted
+	m.mu.Unlock()
+	if monitoring {
+		m.logf("monitoring only, disconnecting %s", ev.Src)
+		m.hangUp()
+		return
+	}
+	if ev.Dst == "" || dataConn == nil {
+		m.logf("can't accept incoming connection from %s", ev.Src)
+		m.abortConnect()
+		return
+	}
+	m.mu.Lock()
+	admitted, hook := m.config.admits(ev.Src) && !m.banned(ev.Src, time.Now()), m.acceptHook
+	limited := m.rateLimited(ev.Src, time.Now())
+	m.mu.Unlock()
+	if admitted && limited {
+		m.logf("%s connects too often", ev.Src)
+		admitted = false
+	}
+	if admitted && hook != nil {
+		admitted = hook(ev.Src)
+	}
+	if !admitted {
+		m.logf("refusing connection from %s", ev.Src)
+		m.hangUp()
+		return
+	}
+	m.mu.Lock()
+	m.fromCall, m.toCall = ev.Dst, ev.Src
+	m.mu.Unlock()
+	conn := newDataConn(m, dataConn, true)
+	select {
+	case m.incoming <- conn:
+		m.mu.Lock()
+		timeout := m.config.AcceptQueueTimeout
+		m.mu.Unlock()
+		time.AfterFunc(timeout, func() { m.expireIncoming(conn, ev.Src) })
+	default:
+		m.logf("not accepting connections, disconnecting %s", ev.Src)
+		m.hangUp()
+	}
+}
+
+// expireIncoming disconnects the session from caller if it is still waiting for Accept.
+func (m *Modem) expireIncoming(conn *varaDataConn, caller string) {
+	select {
+	case queued := <-m.incoming:
+		if queued != conn {
+			// A later session; leave it be
+			select {
+			case m.incoming <- queued:
+			default:
+			}
+			return
+		}
+	default:
+		return
+	}
+	m.logf("session from %s wasn't accepted in time, disconnecting", caller)
+	conn.closeOnce.Do(func() { close(conn.done) })
+	m.hangUp()
+}
+
+// rateLimited records a session from call at now and reports whether call exceeds the rate limit.
+// Refused sessions count too, so a looping station stays refused until it backs off. The caller
+// must hold mu.
+func (m *Modem) rateLimited(call string, now time.Time) bool {
+	limit := m.config.RateLimit
+	if limit.MaxSessions <= 0 {
+		return false
+	}
+	if m.inboundLog == nil {
+		m.inboundLog = make(map[string][]time.Time)
+	}
+	call = strings.ToUpper(call)
+	for c, times := range m.inboundLog {
+		recent := times[:0]
+		for _, t := range times {
+			if now.Sub(t) < limit.Window {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) == 0 {
+			delete(m.inboundLog, c)
+		} else {
+			m.inboundLog[c] = recent
+		}
+	}
+	m.inboundLog[call] = append(m.inboundLog[call], now)
+	return len(m.inboundLog[call]) > limit.MaxSessions
+}
+
+// hangUp disconnects the current session without waiting for it, aborting it if VARA doesn't
+// confirm within DisconnectTimeout.
+func (m *Modem) hangUp() {
+	cmds, cancel := m.cmdSubscribe()
+	if err := m.writeCmd("DISCONNECT"); err != nil {
+		m.debugf("disconnect failed: %v", err)
+		cancel()
+		return
+	}
+	m.mu.Lock()
+	timeout := m.config.DisconnectTimeout
+	m.mu.Unlock()
+	go func() {
+		defer cancel()
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			select {
+			case ev, ok := <-cmds:
+				if !ok || ev == (Disconnected{}) {
+					return
+				}
+			case <-timer.C:
+				m.logf("Disconnect failed, aborting!")
+				if err := m.writeCmd("ABORT"); err != nil {
+					m.debugf("abort failed: %v", err)
+				}
+				return
+			}
+		}
+	}()
+}
+
+func (m *Modem) setPending(pending bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending = pending
 }
 
 func (m *Modem) handleDisconnect() {
+	m.mu.Lock()
 	m.lastState = disconnected
-	m.connectChange <- disconnected
+	m.pending = false
+	dataConn, cmdConn, current := m.dataConn, m.cmdConn, m.current
+	m.dataConn, m.cmdConn = nil, nil
+	m.mu.Unlock()
+	m.setConnectChange(disconnected)
+	m.endSession()
 
-	// Close data port TCP connection
-	m.dataConn = disconnectTCP("data", m.dataConn)
+	// Close data port TCP connection, once the session has read what is left on it
+	if current != nil {
+		current.linkGone()
+	} else {
+		m.disconnectTCP("data", dataConn)
+	}
 	// Close command port TCP connection
-	m.cmdConn = disconnectTCP("cmd", m.cmdConn)
+	m.disconnectTCP("cmd", cmdConn)
+}
+
+// SendCQ transmits a CQ frame announcing this station.
+func (m *Modem) SendCQ() error {
+	// Open the VARA command TCP port if it isn't
+	if err := m.ensureOpen(m.configEndpoint()); err != nil {
+		return err
+	}
+	if err := m.writeMyCall(); err != nil {
+		return err
+	}
+	if m.scheme == "varahf" {
+		// VARA HF wants the bandwidth to call on; assume its default unless one was selected
+		bw := m.selectedBandwidth()
+		if bw == "" {
+			bw = "2300"
+		}
+		return m.writeCmd(fmt.Sprintf("CQFRAME %s %s", m.callsigns()[0], bw))
+	}
+	return m.writeCmd(fmt.Sprintf("CQFRAME %s", m.callsigns()[0]))
+}
+
+// CQNotifications returns a channel receiving the callsign of each station heard calling CQ. See
+// HeardStations for details about them.
+//
+// CQ frames are only reported while the command connection to VARA is open. Frames are dropped
+// if the channel is not drained.
+func (m *Modem) CQNotifications() <-chan string {
+	return m.cq
+}
+
+func (m *Modem) handleCQ(ev CQFrame) {
+	m.recordHeard(ev)
+	select {
+	case m.cq <- ev.Src:
+	default:
+		m.debugf("CQ notification dropped: %v", ev.Src)
+	}
+}
+
+// handleBuffer records the TX buffer size n reported by VARA, e.g. "BUFFER 1024".
+func (m *Modem) handleBuffer(n int) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// VARA was transmitting all along if the buffer wasn't empty at the last report
+	if sent := m.txBuffer - n; sent > 0 && !m.bufferAt.IsZero() {
+		if dt := now.Sub(m.bufferAt).Seconds(); dt > 0 {
+			rate := float64(sent) / dt
+			if m.txRate == 0 {
+				m.txRate = rate
+			} else {
+				m.txRate += (rate - m.txRate) / 4
+			}
+		}
+	}
+	if n < m.txBuffer || m.txBuffer == 0 {
+		m.txProgress = now
+	}
+	m.txBuffer, m.txReported = n, n
+	m.bufferAt = time.Time{}
+	if n > 0 {
+		m.bufferAt = now
+	}
+}
+
+// handleSN records a signal-to-noise report, e.g. "SN 12" or "SN -3.5".
+func (m *Modem) handleSN(snr float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snr = int(math.Round(snr))
+	m.hasSNR = true
+	if m.lastState != connected {
+		m.heardSNR(m.snr)
+		return
+	}
+	q := &m.quality
+	if q.Reports == 0 || m.snr < q.Min {
+		q.Min = m.snr
+	}
+	if q.Reports == 0 || m.snr > q.Max {
+		q.Max = m.snr
+	}
+	q.Reports++
+	q.Last = m.snr
+	q.Mean += (float64(m.snr) - q.Mean) / float64(q.Reports)
+}
+
+// setConnectChange reports a connection state change, replacing any change nobody has picked up
+// yet so the listener never blocks and waiters never see a stale state.
+func (m *Modem) setConnectChange(state connectedState) {
+	select {
+	case <-m.connectChange:
+	default:
+	}
+	m.connectChange <- state
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
 
+// Ping reports whether VARA answers a VERSION request.
 func (m *Modem) Ping() bool {
-	// TODO
-	return true
+	_, err := m.Version()
+	return err == nil
 }
 
+// Version returns the version reported by VARA.
 func (m *Modem) Version() (string, error) {
-	// TODO
-	return "v1", nil
+	ctx, cancel := context.WithTimeout(context.Background(), versionTimeout)
+	defer cancel()
+	return m.version(ctx)
+}
+
+func (m *Modem) version(ctx context.Context) (string, error) {
+	// Open the VARA command TCP port if it isn't
+	if err := m.ensureOpen(m.configEndpoint()); err != nil {
+		return "", err
+	}
+	reply, err := m.request(ctx, "VERSION", func(ev Event) bool { _, ok := ev.(Version); return ok })
+	if err != nil {
+		return "", err
+	}
+	return reply.(Version).Release, nil
 }
 
-// If env var VARA_DEBUG exists, log more stuff
-func debugPrint(msg string) {
-	if debug {
-		log.Printf("[VARA] %s", msg)
+// request sends cmd and waits for the reply accepted by isReply, failing if VARA answers WRONG.
+func (m *Modem) request(ctx context.Context, cmd string, isReply func(Event) bool) (Event, error) {
+	cmds, cancel := m.cmdSubscribe()
+	defer cancel()
+	if err := m.writeCmd(cmd); err != nil {
+		return nil, err
 	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no reply to %s: %w", cmd, ctx.Err())
+		case ev, ok := <-cmds:
+			if !ok {
+				return nil, ErrModemClosed
+			}
+			if ev == (Reply{OK: false}) {
+				return nil, fmt.Errorf("VARA rejected %s", cmd)
+			}
+			if isReply(ev) {
+				return ev, nil
+			}
+		}
+	}
+}
+
+// healthCheck fails fast if VARA is unresponsive, rejects MYCALL or has lost its soundcard.
+func (m *Modem) healthCheck(ctx context.Context, timeout time.Duration) error {
+	m.mu.Lock()
+	missing := m.soundcardMissing
+	m.mu.Unlock()
+	if missing {
+		return ErrSoundcardMissing
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if _, err := m.version(ctx); err != nil {
+		return fmt.Errorf("VARA health check failed: %w", err)
+	}
+	// VARA answers in order, so the reply to VERSION came after those to earlier commands and the
+	// next OK is for MYCALL
+	if _, err := m.request(ctx, m.myCallCmd(), func(ev Event) bool { return ev == (Reply{OK: true}) }); err != nil {
+		return fmt.Errorf("VARA health check failed: %w", err)
+	}
+	return nil
 }
@@ -1,10 +1,24 @@
 package vara
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/la5nta/wl2k-go/transport"
+	"golang.org/x/net/nettest"
 )
 
 func TestInterfaces(t *testing.T) {
@@ -13,6 +27,9 @@ func TestInterfaces(t *testing.T) {
 	// Ensure modem implements the necessary interfaces
 	// (https://github.com/la5nta/pat/wiki/Adding-transports)
 	var _ transport.Dialer = modem
+	var _ interface {
+		DialURLContext(context.Context, *transport.URL) (net.Conn, error)
+	} = modem
 	// Modem doesn't need to implement net.Conn, but DialURL should return one
 
 	// Ensure modem implements optional interfaces with extended functionality
@@ -26,3 +43,3014 @@ func TestBandwidths(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestSchemes(t *testing.T) {
+	if _, err := NewModem("varaxyz", "N0CALL", ModemConfig{}); !errors.Is(err, transport.ErrUnsupportedScheme) {
+		t.Errorf("got %v, expected ErrUnsupportedScheme", err)
+	}
+
+	// VARA FM has no bandwidth commands
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varafm", "N0CALL", f.config())
+	url, _ := transport.ParseURL("varafm:///LA1B?bw=500")
+	if _, err := modem.DialURL(url); err == nil {
+		t.Error("expected error for bandwidth selection with VARA FM")
+	}
+}
+
+func TestConnBandwidth(t *testing.T) {
+	tests := []struct {
+		url       string
+		connected string
+		want      string
+	}{
+		{"varahf:///LA1B?bw=500", "CONNECTED N0CALL LA1B 500", "500"},
+		{"varafm:///LA1B", "CONNECTED N0CALL LA1B via DIGI1 WIDE", "WIDE"},
+		{"varafm:///LA1B", "CONNECTED N0CALL LA1B NARROW", "NARROW"},
+		{"varasat:///LA1B", "CONNECTED N0CALL LA1B", ""},
+	}
+	for _, tt := range tests {
+		f := newFakeVARA(t)
+		url, _ := transport.ParseURL(tt.url)
+		modem, _ := NewModem(url.Scheme, "N0CALL", f.config())
+		done := make(chan net.Conn, 1)
+		go func() {
+			conn, _ := modem.DialURL(url)
+			done <- conn
+		}()
+		f.expect("CONNECT N0CALL LA1B")
+		f.send(tt.connected)
+		conn := <-done
+		if conn == nil {
+			t.Fatalf("%s: dial failed", tt.url)
+		}
+		if got := conn.(*varaDataConn).Bandwidth(); got != tt.want {
+			t.Errorf("%q: got bandwidth %q, expected %q", tt.connected, got, tt.want)
+		}
+	}
+}
+
+func TestCloseAbortsAfterDisconnectTimeout(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.DisconnectTimeout = 50 * time.Millisecond
+	conn := f.dial(config, "varafm:///LA1B")
+
+	// Never confirm the disconnect; Close should give up and abort
+	done := make(chan error, 1)
+	go func() { done <- conn.Close() }()
+	f.expect("DISCONNECT")
+	f.expect("ABORT")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Close returned error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return after abort")
+	}
+}
+
+func TestWaitNotBusy(t *testing.T) {
+	f := newFakeVARA(t)
+	modem := f.start(f.config())
+
+	if err := modem.WaitNotBusy(context.Background()); err != nil {
+		t.Fatalf("idle channel: got %v", err)
+	}
+
+	f.send("BUSY ON")
+	waitFor(t, modem.Busy)
+	done := make(chan error, 1)
+	go func() { done <- modem.WaitNotBusy(context.Background()) }()
+	f.send("BUSY OFF")
+	if err := <-done; err != nil {
+		t.Fatalf("BUSY OFF: got %v", err)
+	}
+
+	f.send("BUSY ON")
+	waitFor(t, modem.Busy)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := modem.WaitNotBusy(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("cancelled wait: got %v", err)
+	}
+
+	go func() { done <- modem.WaitNotBusy(context.Background()) }()
+	f.send("DISCONNECTED")
+	if err := <-done; !errors.Is(err, ErrModemClosed) {
+		t.Fatalf("torn down modem: got %v, expected ErrModemClosed", err)
+	}
+}
+
+func TestWriteContextCancel(t *testing.T) {
+	f := newFakeVARA(t)
+	conn := f.dial(f.config(), "varafm:///LA1B").(*varaDataConn)
+	deadline := time.Now().Add(time.Hour)
+	_ = conn.SetWriteDeadline(deadline)
+
+	// The fake never reads the data port, so this write blocks once the socket buffers are full
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.WriteContext(ctx, make([]byte, 64<<20))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("got %v, expected context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WriteContext did not return after cancel")
+	}
+
+	// The caller's deadline survives the cancel
+	conn.deadlineMu.Lock()
+	defer conn.deadlineMu.Unlock()
+	if !conn.writeDeadline.Equal(deadline) {
+		t.Errorf("write deadline is %v after cancel, expected %v", conn.writeDeadline, deadline)
+	}
+}
+
+func TestModemClosed(t *testing.T) {
+	tests := []struct {
+		name   string
+		linger int // SetLinger(0) makes Close send RST instead of FIN
+		want   error
+	}{
+		{"EOF", -1, ErrModemClosedRemotely},
+		{"reset", 0, ErrModemReset},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeVARA(t)
+			modem := f.start(f.config())
+			closed := modem.ModemClosed()
+
+			c := <-f.cmdConn
+			_ = c.(*net.TCPConn).SetLinger(tt.linger)
+			_ = c.Close()
+
+			select {
+			case err := <-closed:
+				if !errors.Is(err, tt.want) {
+					t.Fatalf("got %v, expected %v", err, tt.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for ModemClosed")
+			}
+			if err := modem.LastError(); !errors.Is(err, tt.want) {
+				t.Fatalf("LastError: got %v, expected %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCQ(t *testing.T) {
+	f := newFakeVARA(t)
+	modem, err := NewModem("varahf", "N0CALL", f.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := modem.SendCQ(); err != nil {
+		t.Fatal(err)
+	}
+	// The bandwidth set in VARA is left alone unless a URL asks for one
+	for cmd := ""; cmd != "CQFRAME N0CALL 2300"; {
+		select {
+		case cmd = <-f.cmds:
+			if strings.HasPrefix(cmd, "BW") {
+				t.Fatalf("unexpected %q", cmd)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for CQFRAME")
+		}
+	}
+
+	f.send("CQFRAME LA1B 500")
+	select {
+	case call := <-modem.CQNotifications():
+		if call != "LA1B" {
+			t.Fatalf("got %q, expected LA1B", call)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for CQ notification")
+	}
+
+	// A bandwidth selected meanwhile is called on
+	url, _ := transport.ParseURL("varahf:///LA1B?bw=500")
+	done := make(chan error, 1)
+	go func() { done <- modem.SendCQ() }()
+	if err := modem.setBandwidth(url); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := modem.SendCQ(); err != nil {
+		t.Fatal(err)
+	}
+	f.expect("CQFRAME N0CALL 500")
+}
+
+func TestHeard(t *testing.T) {
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varahf", "N0CALL", f.config())
+	if err := modem.SendCQ(); err != nil {
+		t.Fatal(err)
+	}
+	f.send("CQFRAME LA1B 500")
+	f.send("SN -3.4")
+	<-modem.CQNotifications()
+	time.Sleep(10 * time.Millisecond)
+	f.send("CQFRAME LA1C 2300")
+	<-modem.CQNotifications()
+
+	heard := modem.HeardStations()
+	if len(heard) != 2 {
+		t.Fatalf("got %+v, expected 2 stations", heard)
+	}
+	if h := heard[0]; h.Callsign != "LA1C" || h.Bandwidth != "2300" || h.HasSNR {
+		t.Errorf("got %+v, expected LA1C at 2300 Hz without S/N", h)
+	}
+	waitFor(t, func() bool { return modem.HeardStations()[1].HasSNR })
+	if h := modem.HeardStations()[1]; h.Callsign != "LA1B" || h.SNR != -3 {
+		t.Errorf("got %+v, expected LA1B at -3 dB", h)
+	}
+	if _, ok := modem.Heard()["LA1B"]; !ok {
+		t.Errorf("LA1B missing from %v", modem.Heard())
+	}
+}
+
+func TestHeardStore(t *testing.T) {
+	store := FileHeardStore(filepath.Join(t.TempDir(), "heard.json"))
+	old := HeardStation{Callsign: "LA1C", Time: time.Now().Add(-48 * time.Hour)}
+	if err := store.SaveHeard([]HeardStation{old}); err != nil {
+		t.Fatal(err)
+	}
+
+	modem, _ := NewModem("varafm", "N0CALL", ModemConfig{})
+	if err := modem.SetHeardStore(store, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if heard := modem.HeardStations(); len(heard) != 0 {
+		t.Fatalf("got %+v, expected LA1C to be pruned", heard)
+	}
+	modem.handleCmd("CQFRAME LA1B")
+	waitFor(t, func() bool {
+		heard, err := store.LoadHeard()
+		return err == nil && len(heard) == 1 && heard[0].Callsign == "LA1B"
+	})
+
+	// The list survives a restart
+	restarted, _ := NewModem("varafm", "N0CALL", ModemConfig{})
+	if err := restarted.SetHeardStore(store, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.Heard()["LA1B"]; !ok {
+		t.Errorf("LA1B missing from %v", restarted.Heard())
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varafm", "N0CALL", f.config())
+	// Monitoring makes VARA answer connect requests, which needs consent
+	if err := modem.Monitor(context.Background()); err != ErrMonitorTransmits {
+		t.Fatalf("got %v, expected ErrMonitorTransmits", err)
+	}
+
+	config := f.config()
+	config.MonitorTransmits = true
+	modem, _ = NewModem("varafm", "N0CALL", config)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- modem.Monitor(ctx) }()
+	f.expect("LISTEN ON")
+
+	f.send("CQFRAME LA1B")
+	if call := <-modem.CQNotifications(); call != "LA1B" {
+		t.Errorf("got %q, expected LA1B", call)
+	}
+
+	// Sessions are refused
+	f.send("CONNECTED LA1C N0CALL")
+	f.expect("DISCONNECT")
+	f.send("DISCONNECTED")
+	f.expect("LISTEN ON") // back to monitoring
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("got %v, expected context.Canceled", err)
+	}
+	f.expect("LISTEN OFF")
+}
+
+func TestConcurrentOpen(t *testing.T) {
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varafm", "N0CALL", f.config())
+
+	// Whoever needs the command connection first opens it, only once
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := modem.SendCQ(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cmdConns != 1 {
+		t.Errorf("got %d command connections, expected 1", f.cmdConns)
+	}
+}
+
+func TestSetPTT(t *testing.T) {
+	f := newFakeVARA(t)
+	modem := f.start(f.config())
+
+	ptt := make(fakePTT, 1)
+	modem.SetPTT(ptt)
+	f.send("PTT ON")
+	if on := <-ptt; !on {
+		t.Fatal("expected PTT on")
+	}
+
+	modem.SetPTT(nil)
+	f.send("PTT OFF")
+	f.send("PTT ON")
+	select {
+	case <-ptt:
+		t.Fatal("PTT request passed through after SetPTT(nil)")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPeriodicIdentification(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	f := newFakeVARA(t)
+	config := f.config()
+	config.IDInterval = interval
+	config.IDText = "DE N0CALL"
+	config.IdleTimeout = 200 * time.Millisecond
+	config.DisconnectTimeout = 50 * time.Millisecond
+	conn := f.dial(config, "varafm:///LA1B")
+	defer func() { _ = conn.(*varaDataConn).TCPConn.Close() }()
+
+	data := <-f.dataConn
+	buf := make([]byte, len(config.IDText))
+	start := time.Now()
+	for i := 1; i <= 3; i++ {
+		if _, err := io.ReadFull(data, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != config.IDText {
+			t.Fatalf("got %q, expected %q", buf, config.IDText)
+		}
+		if elapsed := time.Since(start); elapsed < time.Duration(i)*interval-interval/2 {
+			t.Fatalf("ID %d sent after %v, expected about %v", i, elapsed, time.Duration(i)*interval)
+		}
+	}
+
+	// Identifying doesn't keep an idle session up
+	f.expect("DISCONNECT")
+	if elapsed := time.Since(start); elapsed > 2*config.IdleTimeout {
+		t.Errorf("idle session disconnected after %v, expected about %v", elapsed, config.IdleTimeout)
+	}
+}
+
+func TestSignalReport(t *testing.T) {
+	tests := []struct {
+		cmd    string
+		snr    int
+		wantOK bool
+	}{
+		{"SN 12", 12, true},
+		{"SN -3.6", -4, true},
+		{"SN 7.2", 7, true},
+		{"SN bogus", 7, true}, // skipped, previous report stands
+	}
+	modem, _ := NewModem("varahf", "N0CALL", ModemConfig{})
+	conn := &varaDataConn{modem: modem}
+	if _, ok := conn.SignalReport(); ok {
+		t.Fatal("expected no report before any S/N command")
+	}
+	for _, tt := range tests {
+		modem.handleCmd(tt.cmd)
+		snr, ok := conn.SignalReport()
+		if snr != tt.snr || ok != tt.wantOK {
+			t.Errorf("%q: got (%d, %v), expected (%d, %v)", tt.cmd, snr, ok, tt.snr, tt.wantOK)
+		}
+	}
+}
+
+func TestLinkQuality(t *testing.T) {
+	f := newFakeVARA(t)
+	conn := f.dial(f.config(), "varafm:///LA1B").(*varaDataConn)
+	for _, c := range []string{"SN 4", "SN 10", "SN 7"} {
+		f.send(c)
+	}
+	waitFor(t, func() bool { return conn.LinkQuality().Reports == 3 })
+	want := LinkQuality{Reports: 3, Last: 7, Min: 4, Max: 10, Mean: 7}
+	if got := conn.LinkQuality(); got != want {
+		t.Errorf("got %+v, expected %+v", got, want)
+	}
+}
+
+func TestLinkReportsPerSession(t *testing.T) {
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varafm", "N0CALL", f.config())
+	accept := func(src, bw string) *varaDataConn {
+		t.Helper()
+		done := make(chan net.Conn, 1)
+		go func() {
+			conn, _ := modem.Accept()
+			done <- conn
+		}()
+		f.expect("LISTEN ON")
+		<-f.dataConn
+		f.send("CONNECTED " + src + " N0CALL " + bw)
+		conn := <-done
+		if conn == nil {
+			t.Fatal("Accept failed")
+		}
+		return conn.(*varaDataConn)
+	}
+
+	first := accept("LA1B", "NARROW")
+	f.send("SN 4")
+	f.send("BUFFER 100")
+	waitFor(t, func() bool { return first.TxBufferLen() == 100 })
+	f.send("DISCONNECTED")
+	waitFor(t, func() bool { return len(modem.Sessions()) == 1 })
+
+	// What VARA reports during the next session is none of the first connection's business
+	second := accept("LA1C", "WIDE")
+	f.send("SN -9")
+	f.send("BUFFER 0")
+	waitFor(t, func() bool {
+		snr, ok := second.SignalReport()
+		return ok && snr == -9 && second.TxBufferLen() == 0
+	})
+	if snr, _ := first.SignalReport(); snr != 4 {
+		t.Errorf("got S/N %d, expected 4", snr)
+	}
+	if q := first.LinkQuality(); q.Reports != 1 || q.Last != 4 {
+		t.Errorf("got %+v, expected the first session's report only", q)
+	}
+	if n := first.TxBufferLen(); n != 100 {
+		t.Errorf("got TX buffer %d, expected 100", n)
+	}
+	if bw := first.Bandwidth(); bw != "NARROW" {
+		t.Errorf("got bandwidth %q, expected NARROW", bw)
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	modem, _ := NewModem("varahf", "N0CALL", config, WithLogger(&recordingLogger{}))
+	url, _ := transport.ParseURL("varahf:///LA1B")
+	done := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := modem.DialURL(url)
+		done <- conn
+	}()
+	f.expect("CONNECT N0CALL LA1B")
+	if modem.Registered() {
+		t.Error("registered before VARA said so")
+	}
+	f.send("REGISTERED N0CALL")
+	f.send("CONNECTED N0CALL LA1B 2300")
+	conn := (<-done).(*varaDataConn)
+	if _, ok := conn.LinkRegistered(); ok {
+		t.Error("link registration known before VARA said so")
+	}
+	f.send("LINK UNREGISTERED")
+	select {
+	case w := <-modem.Warnings():
+		if !strings.Contains(w, "unregistered") {
+			t.Errorf("unexpected warning %q", w)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no warning for an unregistered link")
+	}
+	if !modem.Registered() {
+		t.Error("expected modem to be registered")
+	}
+	if registered, ok := conn.LinkRegistered(); registered || !ok {
+		t.Errorf("got (%v, %v), expected an unregistered link", registered, ok)
+	}
+}
+
+func TestAccept(t *testing.T) {
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varafm", "N0CALL", f.config())
+	done := make(chan net.Conn, 1)
+	go func() {
+		conn, err := modem.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		done <- conn
+	}()
+	f.expect("LISTEN ON")
+	data := <-f.dataConn
+
+	// Hold off dialing while someone is connecting to us
+	f.send("PENDING")
+	waitFor(t, func() bool {
+		modem.mu.Lock()
+		defer modem.mu.Unlock()
+		return modem.pending
+	})
+	url, _ := transport.ParseURL("varafm:///LA1C")
+	if _, err := modem.DialURL(url); err != ErrChannelBusy {
+		t.Fatalf("dial while pending: got %v, expected ErrChannelBusy", err)
+	}
+
+	f.send("CONNECTED LA1B N0CALL")
+	conn := <-done
+	if conn == nil {
+		t.Fatal("Accept failed")
+	}
+	if got := conn.RemoteAddr().String(); got != "LA1B" {
+		t.Errorf("got remote address %q, expected LA1B", got)
+	}
+	if _, err := data.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+}
+
+func TestListenLifecycle(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.ConnectTimeout = 50 * time.Millisecond
+	modem, _ := NewModem("varafm", "N0CALL", config)
+	done := make(chan error, 1)
+	go func() {
+		_, err := modem.Accept()
+		done <- err
+	}()
+	f.expect("LISTEN ON")
+	<-f.dataConn
+
+	// Listening pauses while dialing
+	url, _ := transport.ParseURL("varafm:///LA1B")
+	if _, err := modem.DialURL(url); err != ErrConnectTimeout {
+		t.Fatalf("got %v, expected ErrConnectTimeout", err)
+	}
+	for _, cmd := range []string{"LISTEN OFF", "CONNECT N0CALL LA1B", "LISTEN ON"} {
+		f.expect(cmd)
+	}
+
+	// ... and stops when the listener is closed
+	if err := modem.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.expect("LISTEN OFF")
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v, expected net.ErrClosed", err)
+	}
+}
+
+func TestAcceptQueue(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.AcceptQueueTimeout = 100 * time.Millisecond
+	modem, _ := NewModem("varafm", "N0CALL", config)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := modem.AcceptContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, expected context.DeadlineExceeded", err)
+	}
+
+	// A session arriving while nobody is in Accept is queued ...
+	f.send("CONNECTED LA1B N0CALL")
+	time.Sleep(20 * time.Millisecond)
+	conn, err := modem.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.RemoteAddr().String(); got != "LA1B" {
+		t.Errorf("got remote address %q, expected LA1B", got)
+	}
+	f.send("DISCONNECTED")
+
+	// ... but not for long
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := modem.AcceptContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, expected context.DeadlineExceeded", err)
+	}
+	f.send("CONNECTED LA1C N0CALL")
+	f.expect("DISCONNECT")
+}
+
+func TestMaxSessionDuration(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.MaxSessionDuration = 50 * time.Millisecond
+	config.DisconnectTimeout = 50 * time.Millisecond
+	f.dial(config, "varafm:///LA1B")
+	f.expect("DISCONNECT")
+	f.expect("ABORT")
+}
+
+func TestIdleTimeout(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.DisconnectTimeout = 50 * time.Millisecond
+	conn := f.dial(config, "varafm:///LA1B").(*varaDataConn)
+	data := <-f.dataConn
+	conn.SetIdleTimeout(100 * time.Millisecond)
+
+	// Traffic keeps the session up
+	time.Sleep(60 * time.Millisecond)
+	if _, err := data.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	f.notSent("DISCONNECT", 60*time.Millisecond)
+	f.expect("DISCONNECT")
+	f.expect("ABORT")
+}
+
+func TestKeepAlive(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.KeepAliveInterval = 50 * time.Millisecond
+	config.KeepAliveText = "\r"
+	config.IdleTimeout = 200 * time.Millisecond
+	config.DisconnectTimeout = 50 * time.Millisecond
+	f.dial(config, "varafm:///LA1B")
+	data := <-f.dataConn
+
+	// Keepalives are sent, but don't keep the idle timeout from expiring
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(data, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "\r\r" {
+		t.Errorf("got %q, expected keepalives", buf)
+	}
+	f.expect("DISCONNECT")
+	f.expect("ABORT")
+}
+
+func TestStallTimeout(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.StallTimeout = 100 * time.Millisecond
+	config.TxThrottleFactor = 1
+	conn := f.dial(config, "varafm:///LA1B").(*varaDataConn)
+	f.send("BUFFER 500")
+	waitFor(t, func() bool { return conn.TxBufferLen() == 500 })
+
+	// VARA never makes progress
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(make([]byte, 10))
+		done <- err
+	}()
+	f.expect("ABORT")
+	if err := <-done; err != ErrLinkStalled {
+		t.Fatalf("got %v, expected ErrLinkStalled", err)
+	}
+	if _, err := conn.Write(make([]byte, 10)); err != ErrLinkStalled {
+		t.Errorf("got %v from a later write, expected ErrLinkStalled", err)
+	}
+}
+
+func TestMultiListener(t *testing.T) {
+	hf, fm := newFakeVARA(t), newFakeVARA(t)
+	hfModem, _ := NewModem("varahf", "N0CALL", hf.config())
+	fmModem, _ := NewModem("varafm", "N0CALL", fm.config(), WithTimeouts(0, 50*time.Millisecond))
+	ln := NewMultiListener(hfModem, fmModem)
+	var _ net.Listener = ln
+
+	done := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		done <- conn
+	}()
+	hf.expect("LISTEN ON")
+	fm.expect("LISTEN ON")
+	<-fm.dataConn
+	fm.send("CONNECTED LA1B N0CALL")
+	conn := <-done
+	if conn == nil || conn.RemoteAddr().String() != "LA1B" {
+		t.Fatalf("got %v, expected a connection from LA1B", conn)
+	}
+
+	if err := ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v, expected net.ErrClosed", err)
+	}
+
+	// The accepted session outlives the listener
+	fm.notSent("DISCONNECT", 100*time.Millisecond)
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("write after closing the listener: %v", err)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	received := make(chan string, 1)
+	go func() {
+		c, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = c.Write([]byte("[WL2K]"))
+		buf := make([]byte, 4)
+		_, _ = io.ReadFull(c, buf)
+		received <- string(buf)
+		_ = c.Close()
+	}()
+
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varafm", "N0CALL", f.config())
+	bridge := &Bridge{Upstream: upstream.Addr().String()}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- bridge.Serve(ctx, modem) }()
+	f.expect("LISTEN ON")
+	data := <-f.dataConn
+	f.send("CONNECTED LA1B N0CALL")
+
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(data, buf); err != nil || string(buf) != "[WL2K]" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+	if _, err := data.Write([]byte(";FW:")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got != ";FW:" {
+		t.Errorf("upstream got %q", got)
+	}
+
+	// The upstream server hanging up ends the session gracefully
+	f.expect("DISCONNECT")
+	f.send("DISCONNECTED")
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("got %v, expected context.Canceled", err)
+	}
+}
+
+func TestBridgeRemoteHangUp(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		c, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		got, _ := io.ReadAll(c)
+		received <- got
+		_ = c.Close()
+	}()
+
+	f := newFakeVARA(t)
+	config := f.config()
+	config.DisconnectTimeout = 50 * time.Millisecond
+	modem, _ := NewModem("varafm", "N0CALL", config)
+	bridge := &Bridge{Upstream: upstream.Addr().String()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = bridge.Serve(ctx, modem) }()
+	f.expect("LISTEN ON")
+	data := <-f.dataConn
+	f.send("CONNECTED LA1B N0CALL")
+
+	// The station hangs up right after its last words, which still reach upstream
+	if _, err := data.Write([]byte("FF\r")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	f.send("DISCONNECTED")
+	if got := <-received; string(got) != "FF\r" {
+		t.Errorf("upstream got %q", got)
+	}
+	waitFor(t, func() bool { return len(modem.Sessions()) == 1 })
+	if n := modem.Sessions()[0].BytesRead; n != 3 {
+		t.Errorf("got %d bytes read, expected 3", n)
+	}
+}
+
+func TestInboundWhileDialing(t *testing.T) {
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varafm", "N0CALL", f.config())
+	url, _ := transport.ParseURL("varafm:///LA1B")
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	res := make(chan result, 1)
+	go func() {
+		conn, err := modem.DialURL(url)
+		res <- result{conn, err}
+	}()
+	f.expect("CONNECT N0CALL LA1B")
+
+	// Someone else gets through first
+	f.send("CONNECTED LA1C N0CALL")
+	f.expect("DISCONNECT")
+	select {
+	case r := <-res:
+		t.Fatalf("dial ended with %v, %v", r.conn, r.err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	f.send("CONNECTED N0CALL LA1B")
+	r := <-res
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if got := r.conn.RemoteAddr().String(); got != "LA1B" {
+		t.Errorf("got remote address %q, expected LA1B", got)
+	}
+}
+
+func TestListenHoldOff(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.ListenHoldOff = 100 * time.Millisecond
+	modem, _ := NewModem("varafm", "N0CALL", config)
+	go func() { _, _ = modem.Accept() }()
+	f.expect("LISTEN OFF")
+	f.send("BUSY ON")
+	time.Sleep(150 * time.Millisecond)
+	cleared := time.Now()
+	f.send("BUSY OFF")
+	f.expect("LISTEN ON")
+	if d := time.Since(cleared); d < config.ListenHoldOff {
+		t.Errorf("listening %v after the channel cleared, expected at least %v", d, config.ListenHoldOff)
+	}
+	_ = modem.Close()
+}
+
+func TestReadDeadline(t *testing.T) {
+	f := newFakeVARA(t)
+	conn := f.dial(f.config(), "varafm:///LA1B")
+	data := <-f.dataConn
+
+	_ = conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	var netErr net.Error
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) || !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("got %v, expected a timeout", err)
+	}
+
+	// Reads work again once the deadline is lifted
+	_ = conn.SetReadDeadline(time.Time{})
+	if _, err := data.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadAfterDisconnect(t *testing.T) {
+	f := newFakeVARA(t)
+	conn := f.dial(f.config(), "varafm:///LA1B")
+	data := <-f.dataConn
+
+	// The tail of the message is still unread when the remote station hangs up
+	if _, err := data.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	f.send("DISCONNECTED")
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("got %q, expected %q", got, "hello")
+	}
+}
+
+func TestSendCommand(t *testing.T) {
+	f := newFakeVARA(t)
+	f.reject("BW2300")
+	modem, _ := NewModem("varahf", "N0CALL", f.config())
+	url, _ := transport.ParseURL("varahf:///LA1B?bw=2300")
+	var cmdErr *CommandError
+	if _, err := modem.DialURL(url); !errors.As(err, &cmdErr) || cmdErr.Cmd != "BW2300" {
+		t.Fatalf("got %v, expected BW2300 to be rejected", err)
+	}
+
+	// Answers are matched to commands in order, also past commands nobody waits for
+	f.reject("CQFRAME N0CALL 500")
+	if err := modem.writeCmd("CQFRAME N0CALL 500"); err != nil {
+		t.Fatal(err)
+	}
+	if err := modem.sendCommand("BW500"); err != nil {
+		t.Fatal(err)
+	}
+
+	f.reject("CONNECT N0CALL LA1B")
+	url, _ = transport.ParseURL("varahf:///LA1B")
+	if _, err := modem.DialURL(url); !errors.Is(err, ErrCommandRejected) {
+		t.Fatalf("got %v from DialURL, expected ErrCommandRejected", err)
+	}
+
+	f = newFakeVARA(t)
+	f.reject("LISTEN ON")
+	modem, _ = NewModem("varafm", "N0CALL", f.config())
+	if _, err := modem.Accept(); !errors.Is(err, ErrCommandRejected) {
+		t.Fatalf("got %v from Accept, expected ErrCommandRejected", err)
+	}
+}
+
+func TestEndErrors(t *testing.T) {
+	// The remote station hangs up
+	f := newFakeVARA(t)
+	conn := f.dial(f.config(), "varafm:///LA1B")
+	f.send("DISCONNECTED")
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v from Read, expected io.EOF", err)
+	}
+	if _, err := conn.Write([]byte("x")); err != io.EOF {
+		t.Errorf("got %v from Write, expected io.EOF", err)
+	}
+
+	// We hang up
+	f = newFakeVARA(t)
+	config := f.config()
+	config.IdleTimeout = 50 * time.Millisecond
+	conn = f.dial(config, "varafm:///LA1B")
+	f.expect("DISCONNECT")
+	f.send("DISCONNECTED")
+	if _, err := conn.Read(make([]byte, 1)); err != ErrHungUp {
+		t.Errorf("got %v from Read, expected ErrHungUp", err)
+	}
+	if _, err := conn.Write([]byte("x")); err != ErrHungUp {
+		t.Errorf("got %v from Write, expected ErrHungUp", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got %v from Read after Close, expected net.ErrClosed", err)
+	}
+}
+
+func TestNetConn(t *testing.T) {
+	nettest.TestConn(t, func() (c1, c2 net.Conn, stop func(), err error) {
+		f := newFakeVARA(t)
+		config := f.config()
+		// Every write waits for VARA to report its TX buffer drained
+		config.TxThrottleFactor = 1
+		config.DisconnectTimeout = 50 * time.Millisecond // the fake doesn't confirm disconnects
+		c1 = f.dial(config, "varafm:///LA1B")
+		c2 = f.relay(<-f.dataConn)
+		stop = func() {
+			_ = c1.Close()
+			_ = c2.Close()
+		}
+		return c1, c2, stop, nil
+	})
+}
+
+func TestConcurrentUse(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.DisconnectTimeout = 50 * time.Millisecond
+	conn := f.dial(config, "varafm:///LA1B").(*varaDataConn)
+	data := <-f.dataConn
+	go func() { _, _ = io.Copy(data, data) }()
+
+	// One reader, one writer and the modem's own goroutines, racing a Close
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 100)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			_ = conn.SetDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			f.send(fmt.Sprintf("BUFFER %d", i*10))
+			_ = conn.TxBufferLen()
+			_ = conn.Stats()
+		}
+		f.send("DISCONNECTED")
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := conn.Close(); err != nil {
+		t.Error(err)
+	}
+	wg.Wait()
+}
+
+func TestZeroLengthIO(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.DisconnectTimeout = 50 * time.Millisecond
+	conn := f.dial(config, "varafm:///LA1B").(*varaDataConn)
+	f.send("BUFFER 100000")
+	waitFor(t, func() bool { return conn.TxBufferLen() == 100000 })
+
+	// Neither waits for data nor for VARA's TX buffer
+	if n, err := conn.Read(nil); n != 0 || err != nil {
+		t.Errorf("zero-length read: got %d, %v", n, err)
+	}
+	if n, err := conn.Write(nil); n != 0 || err != nil {
+		t.Errorf("zero-length write: got %d, %v", n, err)
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range [][]byte{nil, make([]byte, 10)} {
+		if _, err := conn.Read(b); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("read of %d bytes after Close: got %v, expected net.ErrClosed", len(b), err)
+		}
+		if _, err := conn.Write(b); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("write of %d bytes after Close: got %v, expected net.ErrClosed", len(b), err)
+		}
+	}
+	if err := conn.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("second Close: got %v, expected net.ErrClosed", err)
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	f := newFakeVARA(t)
+	conn := f.dial(f.config(), "varafm:///LA1B").(*varaDataConn)
+	f.send("BUFFER 10000")
+	waitFor(t, func() bool { return conn.TxBufferLen() == 10000 })
+
+	// The deadline applies while waiting for VARA's TX buffer to drain
+	_ = conn.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	start := time.Now()
+	var netErr net.Error
+	if _, err := conn.Write([]byte("hello")); !errors.Is(err, os.ErrDeadlineExceeded) || !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("got %v, expected a timeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Write took %v", d)
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	f := newFakeVARA(t)
+	conn := f.dial(f.config(), "varafm:///LA1B").(*varaDataConn)
+	data := <-f.dataConn
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- conn.CloseWrite() }()
+	select {
+	case err := <-done:
+		t.Fatalf("CloseWrite returned %v before VARA's TX buffer drained", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	f.send("BUFFER 0")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Write([]byte("more")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got %v, expected net.ErrClosed", err)
+	}
+	if _, err := data.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Errorf("read after CloseWrite: %v", err)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	f := newFakeVARA(t)
+	conn := f.dial(f.config(), "varafm:///LA1B").(*varaDataConn)
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := conn.FlushContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, expected context.DeadlineExceeded", err)
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if err := conn.Flush(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, expected os.ErrDeadlineExceeded", err)
+	}
+
+	_ = conn.SetWriteDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() { done <- conn.Flush() }()
+	f.send("BUFFER 0")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBufferTimeout(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.BufferTimeout = 50 * time.Millisecond
+	conn := f.dial(config, "varafm:///LA1B").(*varaDataConn)
+	f.send("BUFFER 10000")
+	waitFor(t, func() bool { return conn.TxBufferLen() == 10000 })
+
+	// VARA never reports progress
+	start := time.Now()
+	if err := conn.Flush(); err == nil {
+		t.Fatal("expected Flush to time out")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Flush took %v", d)
+	}
+}
+
+func TestFlushProgress(t *testing.T) {
+	f := newFakeVARA(t)
+	conn := f.dial(f.config(), "varafm:///LA1B").(*varaDataConn)
+	progress := make(chan int, 10)
+	conn.SetFlushProgress(func(remaining int) { progress <- remaining })
+	if _, err := conn.Write(make([]byte, 3200)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- conn.Flush() }()
+	if got := <-progress; got != 3200 {
+		t.Errorf("got %d bytes remaining, expected 3200", got)
+	}
+	f.send("BUFFER 1200")
+	if got := <-progress; got != 1200 {
+		t.Errorf("got %d bytes remaining, expected 1200", got)
+	}
+	f.send("BUFFER 0")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	<-progress
+
+	// Closing reports the progress as well
+	if _, err := conn.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	go func() { done <- conn.Close() }()
+	if got := <-progress; got != 100 {
+		t.Errorf("got %d bytes remaining, expected 100", got)
+	}
+	f.expect("DISCONNECT")
+	f.send("BUFFER 0")
+	if got := <-progress; got != 0 {
+		t.Errorf("got %d bytes remaining, expected 0", got)
+	}
+	f.send("DISCONNECTED")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCleanTXBuffer(t *testing.T) {
+	f := newFakeVARA(t)
+	conn := f.dial(f.config(), "varafm:///LA1B").(*varaDataConn)
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.CleanTXBuffer(); err != nil {
+		t.Fatal(err)
+	}
+	f.expect("CLEANTXBUFFER")
+	if n := conn.TxBufferLen(); n != 0 {
+		t.Errorf("got TxBufferLen %d, expected 0", n)
+	}
+}
+
+func TestCloseAbort(t *testing.T) {
+	f := newFakeVARA(t)
+	conn := f.dial(f.config(), "varafm:///LA1B").(*varaDataConn)
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetLinger(0)
+	done := make(chan error, 1)
+	go func() { done <- conn.Close() }()
+	f.expect("ABORT")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked")
+	}
+}
+
+func TestAbort(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.TxThrottleFactor = 1
+	conn := f.dial(config, "varafm:///LA1B").(*varaDataConn)
+	f.send("BUFFER 1000")
+	waitFor(t, func() bool { return conn.TxBufferLen() == 1000 })
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte("hello"))
+		written <- err
+	}()
+	closed := make(chan error, 1)
+	go func() { closed <- conn.Close() }()
+	f.expect("DISCONNECT")
+
+	// The user gives up on the graceful disconnect
+	if err := conn.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	f.expect("ABORT")
+	f.send("DISCONNECTED")
+	if err := <-written; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got %v from Write, expected net.ErrClosed", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close still waiting after Abort")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	f := newFakeVARA(t)
+	conn := f.dial(f.config(), "varafm:///LA1B")
+	modem := conn.(*varaDataConn).modem
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	f.send("DISCONNECTED")
+	waitFor(t, func() bool { return len(modem.Sessions()) == 1 })
+
+	s := modem.ResetSessions()[0]
+	if s.LocalCall != "N0CALL" || s.RemoteCall != "LA1B" || s.Inbound || s.BytesWritten != 5 || s.Duration <= 0 {
+		t.Errorf("got %+v", s)
+	}
+	if sessions := modem.Sessions(); len(sessions) != 0 {
+		t.Errorf("got %+v after reset", sessions)
+	}
+}
+
+func TestSessionInfo(t *testing.T) {
+	f := newFakeVARA(t)
+	before := time.Now()
+	conn := f.dial(f.config(), "varahf:///LA1B?p2p=true").(*varaDataConn)
+	info := conn.SessionInfo()
+	if info.LocalCall != "N0CALL" || info.RemoteCall != "LA1B" || info.Inbound || info.Mode != P2PSession || info.Started.Before(before) {
+		t.Errorf("got %+v", info)
+	}
+}
+
+func TestAcceptAlias(t *testing.T) {
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varafm", "N0CALL", f.config(), WithAliases("N0CALL-10"))
+	done := make(chan net.Conn, 1)
+	go func() {
+		conn, err := modem.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		done <- conn
+	}()
+	f.expect("LISTEN ON")
+	<-f.dataConn
+	f.send("CONNECTED LA1B N0CALL-10")
+	conn := <-done
+	if conn == nil {
+		t.Fatal("Accept failed")
+	}
+	if got := conn.LocalAddr().String(); got != "N0CALL-10" {
+		t.Errorf("got local address %q, expected N0CALL-10", got)
+	}
+	if info := conn.(*varaDataConn).SessionInfo(); info.LocalCall != "N0CALL-10" || info.RemoteCall != "LA1B" || !info.Inbound {
+		t.Errorf("got %+v", info)
+	}
+}
+
+func TestAcceptDeny(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.Deny = []string{"LA1B"}
+	config.DisconnectTimeout = 50 * time.Millisecond
+	modem, _ := NewModem("varafm", "N0CALL", config)
+	done := make(chan net.Conn, 1)
+	go func() {
+		conn, err := modem.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		done <- conn
+	}()
+	f.expect("LISTEN ON")
+	<-f.dataConn
+
+	// A denied station is disconnected, and aborted if it doesn't go away
+	f.send("CONNECTED LA1B-5 N0CALL")
+	f.expect("DISCONNECT")
+	f.expect("ABORT")
+	f.send("DISCONNECTED")
+
+	f.expect("LISTEN ON")
+	<-f.dataConn
+	f.send("CONNECTED LA1C N0CALL")
+	if conn := <-done; conn == nil || conn.RemoteAddr().String() != "LA1C" {
+		t.Fatalf("got %v, expected a connection from LA1C", conn)
+	}
+}
+
+func TestAcceptHook(t *testing.T) {
+	f := newFakeVARA(t)
+	calls := make(chan string, 2)
+	modem, _ := NewModem("varafm", "N0CALL", f.config(), WithAcceptHook(func(call string) bool {
+		calls <- call
+		return call != "LA1B"
+	}))
+	done := make(chan net.Conn, 1)
+	go func() {
+		conn, err := modem.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		done <- conn
+	}()
+	f.expect("LISTEN ON")
+	<-f.dataConn
+
+	f.send("CONNECTED LA1B N0CALL")
+	f.expect("DISCONNECT")
+	if call := <-calls; call != "LA1B" {
+		t.Errorf("hook got %q, expected LA1B", call)
+	}
+	f.send("DISCONNECTED")
+
+	f.expect("LISTEN ON")
+	<-f.dataConn
+	f.send("CONNECTED LA1C N0CALL")
+	if conn := <-done; conn == nil || conn.RemoteAddr().String() != "LA1C" {
+		t.Fatalf("got %v, expected a connection from LA1C", conn)
+	}
+	if call := <-calls; call != "LA1C" {
+		t.Errorf("hook got %q, expected LA1C", call)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	modem, _ := NewModem("varafm", "N0CALL", ModemConfig{
+		RateLimit: RateLimit{MaxSessions: 2, Window: time.Hour},
+	})
+	start := time.Now()
+	for i, limited := range []bool{false, false, true, true} {
+		if got := modem.rateLimited("LA1B", start.Add(time.Duration(i)*time.Minute)); got != limited {
+			t.Errorf("session %d: got limited %t, expected %t", i+1, got, limited)
+		}
+	}
+	if modem.rateLimited("LA1C", start) {
+		t.Error("LA1C limited by LA1B's sessions")
+	}
+	// The limit lifts once the station backs off
+	if modem.rateLimited("la1b", start.Add(2*time.Hour)) {
+		t.Error("LA1B still limited after backing off")
+	}
+}
+
+func TestBan(t *testing.T) {
+	modem, _ := NewModem("varafm", "N0CALL", ModemConfig{})
+	if err := modem.Ban("LA1B-99", time.Hour); err == nil {
+		t.Error("expected error banning an invalid callsign")
+	}
+	if err := modem.Ban("la1b", 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := modem.Ban("LA1C-5", 0); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, tt := range []struct {
+		call   string
+		at     time.Time
+		banned bool
+	}{
+		{"LA1B-7", now, true},
+		{"LA1C-5", now, true},
+		{"LA1C", now, false},
+		{"LA1C-5", now.Add(365 * 24 * time.Hour), true},
+		{"LA1B", now.Add(25 * time.Hour), false}, // expired
+	} {
+		modem.mu.Lock()
+		banned := modem.banned(tt.call, tt.at)
+		modem.mu.Unlock()
+		if banned != tt.banned {
+			t.Errorf("%s at %v: got banned %t, expected %t", tt.call, tt.at, banned, tt.banned)
+		}
+	}
+	if _, ok := modem.Bans()["LA1B"]; ok {
+		t.Error("expired ban still listed")
+	}
+	modem.Unban("la1c-5")
+	if bans := modem.Bans(); len(bans) != 0 {
+		t.Errorf("got %v, expected no bans", bans)
+	}
+}
+
+func TestCallsignLists(t *testing.T) {
+	tests := []struct {
+		allow, deny []string
+		call        string
+		admitted    bool
+	}{
+		{nil, nil, "LA1B", true},
+		{nil, []string{"LA1B"}, "LA1B-5", false},
+		{nil, []string{"la1b-5"}, "LA1B-5", false},
+		{nil, []string{"LA1B-5"}, "LA1B", true},
+		{[]string{"LA1B"}, nil, "LA1C", false},
+		{[]string{"LA1B"}, nil, "LA1B-10", true},
+		{[]string{"LA1B"}, []string{"LA1B-10"}, "LA1B-10", false},
+	}
+	for _, tt := range tests {
+		config := ModemConfig{Allow: tt.allow, Deny: tt.deny}
+		if got := config.admits(tt.call); got != tt.admitted {
+			t.Errorf("allow %q, deny %q: %s admitted %t, expected %t", tt.allow, tt.deny, tt.call, got, tt.admitted)
+		}
+	}
+}
+
+func TestAcceptDeadline(t *testing.T) {
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varafm", "N0CALL", f.config())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := modem.AcceptContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, expected context.DeadlineExceeded", err)
+	}
+
+	// The deadline applies to an Accept already waiting
+	done := make(chan error, 1)
+	go func() {
+		_, err := modem.Accept()
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	_ = modem.SetDeadline(time.Now().Add(20 * time.Millisecond))
+	select {
+	case err := <-done:
+		var opErr *net.OpError
+		if !errors.Is(err, os.ErrDeadlineExceeded) || !errors.As(err, &opErr) || !opErr.Timeout() || opErr.Op != "accept" {
+			t.Fatalf("got %v, expected an accept timeout", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept ignored the deadline")
+	}
+
+	// ... until it is lifted
+	_ = modem.SetDeadline(time.Time{})
+	go func() {
+		_, err := modem.Accept()
+		done <- err
+	}()
+	f.send("CONNECTED LA1B N0CALL")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcceptClose(t *testing.T) {
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varafm", "N0CALL", f.config())
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := modem.Accept()
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := modem.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("got %v, expected net.ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close didn't unblock Accept")
+	}
+
+	// The modem can listen again afterwards
+	go func() {
+		_, err := modem.Accept()
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	f.send("CONNECTED LA1B N0CALL")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetCallsigns(t *testing.T) {
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varafm", "N0CALL", f.config())
+
+	for _, calls := range [][]string{
+		nil,
+		{"N0CALL", ""},
+		{"N0CALL", "N0CALL-1", "N0CALL-2", "N0CALL-3", "N0CALL-4", "N0CALL-5"},
+	} {
+		if err := modem.SetCallsigns(calls); err == nil {
+			t.Errorf("%q: expected error", calls)
+		}
+	}
+
+	// Safe to change while the modem is in use
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = modem.Addr()
+		}
+	}()
+	if err := modem.SetCallsigns([]string{"LA1B", "LA1B-10"}); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if got := modem.Addr().String(); got != "LA1B" {
+		t.Errorf("Addr: got %q, expected primary callsign LA1B", got)
+	}
+	if err := modem.SendCQ(); err != nil {
+		t.Fatal(err)
+	}
+	f.expect("MYCALL LA1B LA1B-10")
+}
+
+func TestAliases(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.Aliases = []string{"N0CALL-10", "TAC1"}
+	modem, err := NewModem("varafm", "N0CALL", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, _ := transport.ParseURL("varafm:///LA1B")
+	go func() { _, _ = modem.DialURL(url) }()
+	f.expect("MYCALL N0CALL N0CALL-10 TAC1")
+	f.expect("CONNECT N0CALL LA1B")
+
+	// Connect from an alias
+	f = newFakeVARA(t)
+	config = f.config()
+	config.Aliases = []string{"TAC1"}
+	modem, _ = NewModem("varafm", "N0CALL", config)
+	url, _ = transport.ParseURL("varafm://tac1@/LA1B")
+	done := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := modem.DialURL(url)
+		done <- conn
+	}()
+	f.expect("CONNECT TAC1 LA1B")
+	f.send("CONNECTED TAC1 LA1B")
+	if conn := <-done; conn == nil || conn.LocalAddr().String() != "TAC1" {
+		t.Fatalf("expected a connection from TAC1, got %v", conn)
+	}
+	url, _ = transport.ParseURL("varafm://LA1X@/LA1B")
+	if _, err := modem.DialURL(url); err == nil {
+		t.Error("expected error for unknown source callsign")
+	}
+
+	config.Aliases = []string{"TAC1", "TAC2", "TAC3", "TAC4", "TAC5"}
+	if _, err := NewModem("varafm", "N0CALL", config); err == nil {
+		t.Error("expected error for too many aliases")
+	}
+}
+
+func TestOptions(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	ptt := make(fakePTT, 1)
+	logger := &recordingLogger{}
+	modem, err := NewModem("varafm", "N0CALL", ModemConfig{ConnectTimeout: time.Hour},
+		WithHost(config.Host),
+		WithPorts(config.CmdPort, config.DataPort),
+		WithTimeouts(0, time.Second),
+		WithAliases("N0CALL-1"),
+		WithLogger(logger),
+		WithPTTController(ptt),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modem.config.ConnectTimeout != 0 || modem.config.DisconnectTimeout != time.Second {
+		t.Errorf("got timeouts %v, %v; expected 0, 1s", modem.config.ConnectTimeout, modem.config.DisconnectTimeout)
+	}
+
+	if err := modem.SendCQ(); err != nil {
+		t.Fatal(err)
+	}
+	f.expect("MYCALL N0CALL N0CALL-1")
+	f.send("PTT ON")
+	if on := <-ptt; !on {
+		t.Fatal("expected PTT on")
+	}
+	if modem.log() != Logger(logger) {
+		t.Error("logger not set")
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	tests := []struct {
+		config ModemConfig
+		field  string
+	}{
+		{ModemConfig{Host: " "}, "Host"},
+		{ModemConfig{CmdPort: 70000}, "CmdPort"},
+		{ModemConfig{DataPort: -1}, "DataPort"},
+		{ModemConfig{CmdPort: 8400, DataPort: 8400}, "DataPort"},
+		{ModemConfig{ConnectTimeout: -time.Second}, "ConnectTimeout"},
+		{ModemConfig{Retry: RetryPolicy{Jitter: 2}}, "Retry.Jitter"},
+		{ModemConfig{Deny: []string{"LA1B-99"}}, "Deny"},
+		{ModemConfig{RateLimit: RateLimit{MaxSessions: 3}}, "RateLimit.Window"},
+		{ModemConfig{WriteChunkSize: -1}, "WriteChunkSize"},
+		{ModemConfig{KeepAliveInterval: time.Minute}, "KeepAliveText"},
+	}
+	for _, tt := range tests {
+		_, err := NewModem("varafm", "N0CALL", tt.config)
+		var configErr *ConfigError
+		if !errors.As(err, &configErr) || configErr.Field != tt.field {
+			t.Errorf("%+v: got %v, expected error for %s", tt.config, err, tt.field)
+		}
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%+v: expected %v to match ErrInvalidConfig", tt.config, err)
+		}
+	}
+	if _, err := NewModem("varafm", "N0CALL", ModemConfig{}); err != nil {
+		t.Errorf("defaults: %v", err)
+	}
+}
+
+func TestDataPortDefault(t *testing.T) {
+	tests := []struct {
+		config   ModemConfig
+		dataPort int
+	}{
+		{ModemConfig{}, 8301},
+		{ModemConfig{CmdPort: 8400}, 8401},
+		{ModemConfig{CmdPort: 8400, DataPort: 9000}, 9000},
+		{ModemConfig{DataPort: 9000}, 9000},
+	}
+	for _, tt := range tests {
+		modem, err := NewModem("varafm", "N0CALL", tt.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := modem.config.DataPort; got != tt.dataPort {
+			t.Errorf("%+v: got DataPort %d, expected %d", tt.config, got, tt.dataPort)
+		}
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	f := newFakeVARA(t)
+	modem := f.start(f.config())
+	closed := modem.ModemClosed()
+
+	other := newFakeVARA(t)
+	config := other.config()
+	config.DataPort = 0 // derived from CmdPort
+	if err := modem.Reconfigure(ModemConfig{CmdPort: -1}); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("got %v, expected ErrInvalidConfig", err)
+	}
+	if err := modem.Reconfigure(config); err != nil {
+		t.Fatal(err)
+	}
+	<-closed
+	other.expect("LISTEN OFF") // reconnected and set up
+
+	url, _ := transport.ParseURL("varafm:///LA1B")
+	go func() { _, _ = modem.DialURL(url) }()
+	other.expect("CONNECT N0CALL LA1B")
+	if err := modem.Reconfigure(config); err != ErrDialInProgress {
+		t.Fatalf("got %v, expected ErrDialInProgress", err)
+	}
+	other.send("CONNECTED N0CALL LA1B")
+	waitFor(t, func() bool { return modem.state() == connected })
+	if err := modem.Reconfigure(config); err == nil {
+		t.Fatal("expected error during a session")
+	}
+}
+
+func TestReconfigureDuringAccept(t *testing.T) {
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varafm", "N0CALL", f.config())
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := modem.Accept()
+		accepted <- conn
+	}()
+	f.expect("LISTEN ON")
+
+	// Accept follows the modem to the new VARA program, without reconnecting to the old one
+	other := newFakeVARA(t)
+	if err := modem.Reconfigure(other.config()); err != nil {
+		t.Fatal(err)
+	}
+	other.expect("LISTEN ON")
+	f.notSent("LISTEN", 200*time.Millisecond)
+	other.send("CONNECTED LA1B N0CALL")
+	select {
+	case conn := <-accepted:
+		if conn == nil {
+			t.Fatal("Accept failed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Accept didn't return the session on the new VARA program")
+	}
+}
+
+func TestCmdFraming(t *testing.T) {
+	f := newFakeVARA(t)
+	modem := f.start(f.config())
+	cmds, cancel := modem.cmdSubscribe()
+	defer cancel()
+
+	// Commands split across and sharing TCP segments
+	c := <-f.cmdConn
+	for _, chunk := range []string{"BUFF", "ER 10\rBUSY ON\rPEND", "ING\r"} {
+		if _, err := c.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, want := range []Event{Buffer{10}, Busy{On: true}, Pending{}} {
+		select {
+		case got := <-cmds:
+			if got == (Reply{OK: true}) {
+				// The answer to a setup command
+				got = <-cmds
+			}
+			if got != want {
+				t.Fatalf("got %+v, expected %+v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %+v", want)
+		}
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want Event
+	}{
+		{"CONNECTED N0CALL LA1B 2300", Connected{Src: "N0CALL", Dst: "LA1B", Bandwidth: "2300"}},
+		{"CONNECTED N0CALL LA1B", Connected{Src: "N0CALL", Dst: "LA1B"}},
+		{"CONNECTED N0CALL LA1B via LA1D LA1E WIDE", Connected{Src: "N0CALL", Dst: "LA1B", Via: []string{"LA1D", "LA1E"}, Bandwidth: "WIDE"}},
+		{"DISCONNECTED", Disconnected{}},
+		{"BUFFER 1024", Buffer{1024}},
+		{"BUSY ON", Busy{true}},
+		{"PTT OFF", PTT{false}},
+		{"PENDING", Pending{}},
+		{"WRONG", Reply{false}},
+		{"VERSION 4.7.3", Version{"4.7.3"}},
+		{"SN -3.5", SN{-3.5}},
+		{"CQFRAME LA1B 500", CQFrame{Src: "LA1B", Bandwidth: "500"}},
+		{"CQFRAME LA1B LA1D LA1E", CQFrame{Src: "LA1B", Via: []string{"LA1D", "LA1E"}}},
+		{"CQFRAME LA1B LA1D", CQFrame{Src: "LA1B", Via: []string{"LA1D"}}},
+		{"REGISTERED N0CALL", Registered{"N0CALL"}},
+		{"LINK UNREGISTERED", LinkRegistration{false}},
+		{"FOO BAR", Unknown{"FOO BAR"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseEvent(tt.cmd)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %#v, %v; expected %#v", tt.cmd, got, err, tt.want)
+		}
+	}
+	for _, cmd := range []string{"BUFFER", "BUFFER x", "SN", "CQFRAME"} {
+		if _, err := ParseEvent(cmd); err == nil {
+			t.Errorf("%q: expected error", cmd)
+		}
+	}
+
+	// The modem records malformed commands
+	modem, _ := NewModem("varafm", "N0CALL", ModemConfig{})
+	modem.handleCmd("CQFRAME")
+	if err := modem.LastError(); err == nil || !strings.Contains(err.Error(), "malformed CQ frame") {
+		t.Errorf("got %v from LastError, expected malformed CQ frame", err)
+	}
+}
+
+func TestCheckCallsign(t *testing.T) {
+	for _, call := range []string{"LA1B", "N0CALL", "LA1B-1", "LA1B-15", "LA1B-T", "la1b-r", "OH2ABCD"} {
+		if err := checkCallsign(call); err != nil {
+			t.Errorf("%q: %v", call, err)
+		}
+	}
+	for _, call := range []string{"", "LA", "OH2ABCDE", "LA1B-", "LA1B-0", "LA1B-16", "LA1B-01", "LA1B-X", "LA/1B", "LA1B-1-2"} {
+		if err := checkCallsign(call); err == nil {
+			t.Errorf("%q: expected error", call)
+		}
+	}
+
+	if _, err := NewModem("varafm", "N0", ModemConfig{}); err == nil {
+		t.Error("NewModem: expected error for invalid callsign")
+	}
+	modem, _ := NewModem("varafm", "N0CALL", ModemConfig{})
+	for _, rawurl := range []string{"varafm:///LA1B-99", "varafm:///LA1B?via=X"} {
+		url, _ := transport.ParseURL(rawurl)
+		if _, err := modem.DialURL(url); err == nil || !strings.Contains(err.Error(), "invalid callsign") {
+			t.Errorf("%s: got %v, expected invalid callsign error", rawurl, err)
+		}
+	}
+}
+
+func TestSessionMode(t *testing.T) {
+	tests := []struct {
+		mode SessionMode
+		url  string
+		want string
+	}{
+		{WinlinkSession, "varahf:///LA1B", "WINLINK SESSION"},
+		{P2PSession, "varahf:///LA1B", "P2P SESSION"},
+		{WinlinkSession, "varahf:///LA1B?p2p=true", "P2P SESSION"},
+		{P2PSession, "varahf:///LA1B?p2p=false", "WINLINK SESSION"},
+		{P2PSession, "varasat:///LA1B", "P2P SESSION"},
+	}
+	for _, tt := range tests {
+		f := newFakeVARA(t)
+		config := f.config()
+		config.SessionMode = tt.mode
+		url, _ := transport.ParseURL(tt.url)
+		modem, _ := NewModem(url.Scheme, "N0CALL", config)
+		go func() { _, _ = modem.DialURL(url) }()
+		f.expect(tt.want)
+	}
+}
+
+func TestCmdPortLossUnblocksRead(t *testing.T) {
+	f := newFakeVARA(t)
+	conn := f.dial(f.config(), "varafm:///LA1B")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 10))
+		done <- err
+	}()
+	c := <-f.cmdConn
+	_ = c.(*net.TCPConn).SetLinger(0)
+	_ = c.Close()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected Read to fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read still blocked after losing the command port")
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	var global bytes.Buffer
+	log.SetOutput(&global)
+	defer log.SetOutput(os.Stderr)
+
+	l := &recordingLogger{}
+	modem, _ := NewModem("varafm", "N0CALL", ModemConfig{})
+	modem.SetLogger(l)
+	modem.handleCmd("SOMETHING NEW")
+	modem.handleCmd("REGISTERED N0CALL")
+
+	if len(l.lines) != 2 {
+		t.Errorf("expected 2 lines logged, got %q", l.lines)
+	}
+	if global.Len() > 0 {
+		t.Errorf("global logger was written to: %q", global.String())
+	}
+}
+
+func TestTxThrottle(t *testing.T) {
+	tests := []struct {
+		factor int
+		block  bool
+	}{
+		{0, false}, // default 14 for VARA FM
+		{7, true},
+		{2, true},
+		{20, false},
+		{-1, false},
+	}
+	for _, tt := range tests {
+		f := newFakeVARA(t)
+		config := f.config()
+		config.TxThrottleFactor = tt.factor
+		conn := f.dial(config, "varafm:///LA1B")
+		go func() { _, _ = io.Copy(io.Discard, <-f.dataConn) }()
+
+		f.send("BUFFER 100")
+		waitFor(t, func() bool { return conn.(*varaDataConn).TxBufferLen() == 100 })
+
+		// 10 bytes may only be queued once the buffer is at or below factor*10 bytes
+		done := make(chan error, 1)
+		go func() {
+			_, err := conn.Write(make([]byte, 10))
+			done <- err
+		}()
+		select {
+		case <-done:
+			if tt.block {
+				t.Fatalf("factor %d: Write did not block", tt.factor)
+			}
+			continue
+		case <-time.After(50 * time.Millisecond):
+			if !tt.block {
+				t.Fatalf("factor %d: Write blocked", tt.factor)
+			}
+		}
+		f.send("BUFFER 15")
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("factor %d: Write still blocked after buffer drained", tt.factor)
+		}
+	}
+}
+
+func TestTxBufferTarget(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.TxBufferTarget = 5 * time.Second
+	conn := f.dial(config, "varafm:///LA1B").(*varaDataConn)
+	go func() { _, _ = io.Copy(io.Discard, <-f.dataConn) }()
+
+	// VARA sends about 1000 bytes/s, so up to about 5000 bytes may be queued
+	if _, err := conn.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	f.send("BUFFER 1000")
+	waitFor(t, func() bool { return conn.TxBufferLen() == 1000 })
+	time.Sleep(100 * time.Millisecond)
+	f.send("BUFFER 900")
+	waitFor(t, func() bool { return conn.TxBufferLen() == 900 })
+
+	// The default factor of 14 would hold off this write
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(make([]byte, 10))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Write blocked below the target")
+	}
+
+	f.send("BUFFER 20000")
+	waitFor(t, func() bool { return conn.TxBufferLen() == 20000 })
+	go func() {
+		_, err := conn.Write(make([]byte, 10))
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("Write did not block above the target")
+	case <-time.After(50 * time.Millisecond):
+	}
+	f.send("BUFFER 100")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxBufferReconcile(t *testing.T) {
+	defer func(d time.Duration) { txReconcileInterval = d }(txReconcileInterval)
+	txReconcileInterval = 20 * time.Millisecond
+	f := newFakeVARA(t)
+	conn := f.dial(f.config(), "varafm:///LA1B").(*varaDataConn)
+	go func() { _, _ = io.Copy(io.Discard, <-f.dataConn) }()
+
+	// VARA's report covering the write arrives before the write is counted
+	f.send("BUFFER 100")
+	waitFor(t, func() bool { return conn.TxBufferLen() == 100 })
+	if _, err := conn.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if n := conn.TxBufferLen(); n != 200 {
+		t.Fatalf("got %d, expected 200 before reconciling", n)
+	}
+	waitFor(t, func() bool { return conn.TxBufferLen() == 100 })
+}
+
+func TestThroughput(t *testing.T) {
+	f := newFakeVARA(t)
+	conn := f.dial(f.config(), "varafm:///LA1B").(*varaDataConn)
+	if _, ok := conn.Throughput(); ok {
+		t.Error("got a throughput before any data was sent")
+	}
+
+	f.send("BUFFER 1000")
+	waitFor(t, func() bool { return conn.TxBufferLen() == 1000 })
+	time.Sleep(100 * time.Millisecond)
+	f.send("BUFFER 900")
+	waitFor(t, func() bool { return conn.TxBufferLen() == 900 })
+	if rate, ok := conn.Throughput(); !ok || rate < 500 || rate > 1000 {
+		t.Errorf("got %v, %v, expected about 1000 bytes/s", rate, ok)
+	}
+}
+
+func TestEstimatedFlushDuration(t *testing.T) {
+	f := newFakeVARA(t)
+	conn := f.dial(f.config(), "varafm:///LA1B").(*varaDataConn)
+	if d, ok := conn.EstimatedFlushDuration(); !ok || d != 0 {
+		t.Errorf("got %v, %v with an empty buffer", d, ok)
+	}
+	f.send("BUFFER 1000")
+	waitFor(t, func() bool { return conn.TxBufferLen() == 1000 })
+	if _, ok := conn.EstimatedFlushDuration(); ok {
+		t.Error("got an estimate before the rate is known")
+	}
+
+	// About 1000 bytes/s
+	time.Sleep(100 * time.Millisecond)
+	f.send("BUFFER 900")
+	waitFor(t, func() bool { return conn.TxBufferLen() == 900 })
+	if d, ok := conn.EstimatedFlushDuration(); !ok || d < 900*time.Millisecond || d > 2*time.Second {
+		t.Errorf("got %v, %v, expected about a second", d, ok)
+	}
+}
+
+func TestWriteChunkSize(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.WriteChunkSize = 100
+	config.TxThrottleFactor = 1
+	conn := f.dial(config, "varafm:///LA1B").(*varaDataConn)
+	data := <-f.dataConn
+
+	// The first chunk goes out right away, the second once VARA has sent the first
+	done := make(chan error, 1)
+	go func() {
+		n, err := conn.Write(make([]byte, 150))
+		if err == nil && n != 150 {
+			err = fmt.Errorf("wrote %d bytes", n)
+		}
+		done <- err
+	}()
+	waitFor(t, func() bool { return conn.TxBufferLen() == 100 })
+	select {
+	case err := <-done:
+		t.Fatalf("Write returned %v before the first chunk was sent", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	f.send("BUFFER 0")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(data, make([]byte, 150)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.WriteChunkSize = 100
+	config.TxThrottleFactor = 1
+	conn := f.dial(config, "varafm:///LA1B").(*varaDataConn)
+	data := <-f.dataConn
+
+	// io.Copy must not bypass the throttling
+	done := make(chan error, 1)
+	go func() {
+		n, err := io.Copy(conn, strings.NewReader(strings.Repeat("x", 150)))
+		if err == nil && n != 150 {
+			err = fmt.Errorf("copied %d bytes", n)
+		}
+		done <- err
+	}()
+	waitFor(t, func() bool { return conn.TxBufferLen() == 100 })
+	select {
+	case err := <-done:
+		t.Fatalf("io.Copy returned %v before the first chunk was sent", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	f.send("BUFFER 0")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(data, make([]byte, 150)); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.Stats().BytesWritten; got != 150 {
+		t.Errorf("got %d bytes written, expected 150", got)
+	}
+}
+
+func TestStats(t *testing.T) {
+	f := newFakeVARA(t)
+	before := time.Now()
+	conn := f.dial(f.config(), "varafm:///LA1B").(*varaDataConn)
+	data := <-f.dataConn
+
+	go func() { _, _ = conn.Write([]byte("hello")) }()
+	if _, err := io.ReadFull(data, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := data.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := conn.Stats()
+	if stats.BytesWritten != 5 || stats.BytesRead != 2 {
+		t.Errorf("got %d written, %d read; expected 5, 2", stats.BytesWritten, stats.BytesRead)
+	}
+	if stats.Started.Before(before) || stats.Started.After(time.Now()) {
+		t.Errorf("unexpected start time %v", stats.Started)
+	}
+	if stats.Duration <= 0 || stats.BufferStalls != 0 || stats.Bandwidth != "" {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// A write waiting for VARA's TX buffer to drain
+	f.send("BUFFER 1000")
+	waitFor(t, func() bool { return conn.TxBufferLen() == 1000 })
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte("hello"))
+		done <- err
+	}()
+	waitFor(t, func() bool { return conn.Stats().BufferStalls == 1 })
+	f.send("BUFFER 0")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration stops when the session ends
+	f.send("DISCONNECTED")
+	waitFor(t, func() bool { return len(conn.modem.Sessions()) == 1 })
+	_ = conn.Close()
+	d := conn.Stats().Duration
+	time.Sleep(20 * time.Millisecond)
+	if got := conn.Stats().Duration; got != d {
+		t.Errorf("duration still running: %v, then %v", d, got)
+	}
+}
+
+func TestDialURLContextCancel(t *testing.T) {
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varafm", "N0CALL", f.config())
+	url, _ := transport.ParseURL("varafm:///LA1B")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := modem.DialURLContext(ctx, url)
+		done <- err
+	}()
+	f.expect("CONNECT N0CALL LA1B")
+	cancel()
+	f.expect("ABORT")
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("got %v, expected context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("DialURLContext did not return after cancel")
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.ConnectTimeout = 50 * time.Millisecond
+	modem, _ := NewModem("varafm", "N0CALL", config)
+	url, _ := transport.ParseURL("varafm:///LA1B")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := modem.DialURL(url)
+		done <- err
+	}()
+	f.expect("CONNECT N0CALL LA1B")
+	f.expect("ABORT")
+	if err := <-done; err != ErrConnectTimeout {
+		t.Fatalf("got %v, expected ErrConnectTimeout", err)
+	}
+}
+
+func TestAbortDial(t *testing.T) {
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varafm", "N0CALL", f.config())
+	url, _ := transport.ParseURL("varafm:///LA1B")
+
+	modem.AbortDial() // no dial in progress; nothing happens
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := modem.DialURL(url)
+		done <- err
+	}()
+	f.expect("CONNECT N0CALL LA1B")
+	modem.AbortDial()
+	f.expect("ABORT")
+	if err := <-done; err != ErrDialAborted {
+		t.Fatalf("got %v, expected ErrDialAborted", err)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varahf", "N0CALL", f.config())
+	if v, err := modem.Version(); err != nil || v != "4.7.3" {
+		t.Fatalf("got %q, %v; expected 4.7.3", v, err)
+	}
+	if !modem.Ping() {
+		t.Error("expected Ping to succeed")
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.HealthCheck = time.Second
+	modem, _ := NewModem("varafm", "N0CALL", config)
+	url, _ := transport.ParseURL("varafm:///LA1B")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := modem.DialURL(url)
+		done <- err
+	}()
+	f.expect("VERSION")
+	f.expect("MYCALL N0CALL")
+	f.expect("CONNECT N0CALL LA1B")
+	f.send("CONNECTED N0CALL LA1B")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	f.send("MISSING SOUNDCARD")
+	waitFor(t, func() bool {
+		modem.mu.Lock()
+		defer modem.mu.Unlock()
+		return modem.soundcardMissing
+	})
+	go func() {
+		_, err := modem.DialURL(url)
+		done <- err
+	}()
+	if err := <-done; err != ErrSoundcardMissing {
+		t.Fatalf("got %v, expected ErrSoundcardMissing", err)
+	}
+}
+
+func TestDialInProgress(t *testing.T) {
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varafm", "N0CALL", f.config())
+	url, _ := transport.ParseURL("varafm:///LA1B")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := modem.DialURL(url)
+		done <- err
+	}()
+	f.expect("CONNECT N0CALL LA1B")
+	if _, err := modem.DialURL(url); err != ErrDialInProgress {
+		t.Fatalf("got %v, expected ErrDialInProgress", err)
+	}
+	f.notSent("CONNECT", 50*time.Millisecond)
+
+	// Aborting twice is harmless, and the modem can dial again afterwards
+	modem.AbortDial()
+	modem.AbortDial()
+	if err := <-done; err != ErrDialAborted {
+		t.Fatalf("got %v, expected ErrDialAborted", err)
+	}
+	go func() {
+		_, err := modem.DialURL(url)
+		done <- err
+	}()
+	f.expect("CONNECT N0CALL LA1B")
+	f.send("CONNECTED N0CALL LA1B")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDialFreq(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.BusyLockout = time.Minute
+	modem := f.start(config)
+	url, _ := transport.ParseURL("varafm:///LA1B?freq=144975.5")
+
+	bad, _ := transport.ParseURL("varafm:///LA1B?freq=x")
+	if _, err := modem.DialURL(bad); err == nil {
+		t.Error("expected error for invalid freq")
+	}
+
+	// Busy on the old frequency doesn't keep us from calling on the new one
+	f.send("BUSY ON")
+	waitFor(t, modem.Busy)
+	vfo := make(fakeVFO, 1)
+	modem.SetVFO(vfo)
+	done := make(chan error, 1)
+	go func() {
+		_, err := modem.DialURL(url)
+		done <- err
+	}()
+	if freq := <-vfo; freq != 144975500 {
+		t.Errorf("got QSY to %d Hz, expected 144975500", freq)
+	}
+	f.expect("CONNECT N0CALL LA1B")
+	f.send("CONNECTED N0CALL LA1B")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDialProgress(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.Retry = RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond}
+	modem, _ := NewModem("varafm", "N0CALL", config)
+	url, _ := transport.ParseURL("varafm:///LA1B")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := modem.DialURL(url)
+		done <- err
+	}()
+	f.expect("CONNECT N0CALL LA1B")
+	f.send("DISCONNECTED")
+	f.expect("CONNECT N0CALL LA1B")
+	f.send("PTT ON")
+	f.send("PTT OFF")
+	f.send("CONNECTED N0CALL LA1B")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	want := []DialEvent{
+		{DialCalling, "LA1B", 1},
+		{DialRetrying, "LA1B", 1},
+		{DialCalling, "LA1B", 2},
+		{DialTransmitting, "LA1B", 2},
+		{DialConnected, "LA1B", 2},
+	}
+	for _, w := range want {
+		select {
+		case got := <-modem.DialProgress():
+			if got != w {
+				t.Fatalf("got %+v, expected %+v", got, w)
+			}
+		default:
+			t.Fatalf("missing %v event", w.Stage)
+		}
+	}
+}
+
+func TestSetupAfterRestart(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.Aliases = []string{"N0CALL-1"}
+	modem, _ := NewModem("varahf", "N0CALL", config)
+	url, _ := transport.ParseURL("varahf:///LA1B?bw=500&p2p=true")
+	go func() { _, _ = modem.DialURL(url) }()
+	f.expect("CONNECT N0CALL LA1B")
+	f.send("CONNECTED N0CALL LA1B 500")
+
+	// VARA is restarted
+	closed := modem.ModemClosed()
+	c := <-f.cmdConn
+	_ = c.Close()
+	<-closed
+
+	if err := modem.SendCQ(); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{"PUBLIC ON", "CWID ON", "COMPRESSION TEXT", "MYCALL N0CALL N0CALL-1", "BW500", "LISTEN OFF", "P2P SESSION", "CQFRAME N0CALL 500"} {
+		f.expect(cmd)
+	}
+}
+
+func TestDialFailover(t *testing.T) {
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varafm", "N0CALL", f.config())
+	var urls []*transport.URL
+	for _, rawurl := range []string{"varafm:///LA1A", "varahf:///LA1B", "varafm:///LA1C", "varafm:///LA1D"} {
+		url, _ := transport.ParseURL(rawurl)
+		urls = append(urls, url)
+	}
+
+	type result struct {
+		url *transport.URL
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		_, url, err := modem.DialFailover(context.Background(), urls)
+		done <- result{url, err}
+	}()
+	f.expect("CONNECT N0CALL LA1A")
+	f.send("DISCONNECTED")
+	// LA1B is skipped for the wrong scheme
+	f.expect("CONNECT N0CALL LA1C")
+	f.send("CONNECTED N0CALL LA1C")
+	if r := <-done; r.err != nil || r.url != urls[2] {
+		t.Fatalf("got %v, %v; expected to connect to LA1C", r.url, r.err)
+	}
+
+	// Give up at once if VARA is gone
+	modem, _ = NewModem("varafm", "N0CALL", ModemConfig{Host: "127.0.0.1", CmdPort: 1})
+	if _, _, err := modem.DialFailover(context.Background(), urls); !errors.Is(err, ErrModemUnavailable) {
+		t.Fatalf("got %v, expected ErrModemUnavailable", err)
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.Retry = RetryPolicy{MaxAttempts: 3, Backoff: 10 * time.Millisecond}
+	modem, _ := NewModem("varafm", "N0CALL", config)
+	url, _ := transport.ParseURL("varafm:///LA1B")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := modem.DialURL(url)
+		done <- err
+	}()
+	f.expect("CONNECT N0CALL LA1B")
+	f.send("DISCONNECTED") // no answer
+	f.expect("CONNECT N0CALL LA1B")
+	f.send("CONNECTED N0CALL LA1B")
+	if err := <-done; err != nil {
+		t.Fatalf("expected second attempt to succeed, got %v", err)
+	}
+
+	modem, _ = NewModem("varafm", "N0CALL", ModemConfig{Retry: RetryPolicy{MaxAttempts: 3}})
+	if modem.config.Retry.Backoff != 5*time.Second {
+		t.Errorf("got default backoff %v, expected 5s", modem.config.Retry.Backoff)
+	}
+}
+
+func TestDialErrors(t *testing.T) {
+	// Nothing listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	modem, _ := NewModem("varafm", "N0CALL", ModemConfig{Host: "127.0.0.1", CmdPort: port})
+	url, _ := transport.ParseURL("varafm:///LA1B")
+	_, err = modem.DialURL(url)
+	if !errors.Is(err, ErrModemUnavailable) {
+		t.Errorf("got %v, expected ErrModemUnavailable", err)
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Errorf("expected the network error to be accessible, got %v", err)
+	}
+
+	// No answer
+	f := newFakeVARA(t)
+	modem, _ = NewModem("varafm", "N0CALL", f.config())
+	done := make(chan error, 1)
+	go func() {
+		_, err := modem.DialURL(url)
+		done <- err
+	}()
+	f.expect("CONNECT N0CALL LA1B")
+	f.send("DISCONNECTED")
+	if err := <-done; !errors.Is(err, ErrRemoteRefused) {
+		t.Errorf("got %v, expected ErrRemoteRefused", err)
+	}
+
+	// Commands VARA doesn't document explain nothing
+	go func() {
+		_, err := modem.DialURL(url)
+		done <- err
+	}()
+	f.expect("CONNECT N0CALL LA1B")
+	f.send("BUFFER 0")
+	f.send("REJECTED BUSY")
+	f.send("DISCONNECTED")
+	if err := <-done; err != ErrRemoteRefused {
+		t.Errorf("got %v, expected ErrRemoteRefused", err)
+	}
+
+	// Failed for a reason VARA reported
+	go func() {
+		_, err := modem.DialURL(url)
+		done <- err
+	}()
+	f.expect("CONNECT N0CALL LA1B")
+	f.send("MISSING SOUNDCARD")
+	f.send("DISCONNECTED")
+	err = <-done
+	var refused *RemoteRefusedError
+	if !errors.As(err, &refused) || refused.Reason != "MISSING SOUNDCARD" {
+		t.Fatalf("got %v, expected the reason", err)
+	}
+	if !errors.Is(err, ErrRemoteRefused) {
+		t.Errorf("expected %v to match ErrRemoteRefused", err)
+	}
+}
+
+func TestDialBandwidth(t *testing.T) {
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varahf", "N0CALL", f.config())
+
+	url, _ := transport.ParseURL("varahf:///LA1B?bw=1234")
+	if _, err := modem.DialURL(url); err == nil {
+		t.Fatal("expected error for unsupported bandwidth")
+	}
+	if modem.cmdOpen() {
+		t.Fatal("modem was set up despite unsupported bandwidth")
+	}
+
+	url, _ = transport.ParseURL("varahf:///LA1B?bw=500")
+	go func() { _, _ = modem.DialURL(url) }()
+	f.expect("BW500")
+	f.expect("CONNECT N0CALL LA1B")
+}
+
+func TestDialDigipeaters(t *testing.T) {
+	for _, rawurl := range []string{
+		"varafm:///LA1B?via=DIGI1,DIGI2",
+		"varafm:///DIGI1/DIGI2/LA1B",
+	} {
+		f := newFakeVARA(t)
+		modem, _ := NewModem("varafm", "N0CALL", f.config())
+		url, _ := transport.ParseURL(rawurl)
+		go func() { _, _ = modem.DialURL(url) }()
+		f.expect("CONNECT N0CALL LA1B via DIGI1 DIGI2")
+	}
+
+	modem, _ := NewModem("varahf", "N0CALL", ModemConfig{})
+	url, _ := transport.ParseURL("varahf:///LA1B?via=DIGI1")
+	if _, err := modem.DialURL(url); err == nil {
+		t.Fatal("expected error for digipeaters on VARA HF")
+	}
+}
+
+func TestDialURLHost(t *testing.T) {
+	configured, other := newFakeVARA(t), newFakeVARA(t)
+	modem := configured.start(configured.config())
+	closed := modem.ModemClosed()
+
+	url, _ := transport.ParseURL(fmt.Sprintf("varafm://%s/LA1B", other.cmdLn.Addr()))
+	go func() { _, _ = modem.DialURL(url) }()
+	other.expect("CONNECT N0CALL LA1B")
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection to the configured modem was not closed")
+	}
+
+	url, _ = transport.ParseURL("varafm://localhost:99999/LA1B")
+	if _, err := modem.DialURL(url); err == nil {
+		t.Fatal("expected error for invalid port")
+	}
+}
+
+func TestBusyLockout(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.BusyLockout = time.Hour
+	modem := f.start(config)
+	url, _ := transport.ParseURL("varafm:///LA1B")
+
+	f.send("BUSY ON")
+	f.send("BUSY OFF")
+	waitFor(t, func() bool { return modem.busyWithin(time.Hour) && !modem.Busy() })
+	if _, err := modem.DialURL(url); err != ErrChannelBusy {
+		t.Fatalf("got %v, expected ErrChannelBusy", err)
+	}
+	f.expect("MYCALL N0CALL")
+	f.notSent("CONNECT", 50*time.Millisecond)
+}
+
+func TestBusyWait(t *testing.T) {
+	f := newFakeVARA(t)
+	config := f.config()
+	config.BusyWait = time.Second
+	modem := f.start(config)
+	url, _ := transport.ParseURL("varafm:///LA1B")
+
+	f.send("BUSY ON")
+	waitFor(t, modem.Busy)
+	done := make(chan error, 1)
+	go func() {
+		_, err := modem.DialURL(url)
+		done <- err
+	}()
+	f.expect("MYCALL N0CALL")
+	f.notSent("CONNECT", 50*time.Millisecond)
+	f.send("BUSY OFF")
+	f.expect("CONNECT N0CALL LA1B")
+	f.send("CONNECTED N0CALL LA1B")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	f = newFakeVARA(t)
+	config = f.config()
+	config.BusyWait = 50 * time.Millisecond
+	modem = f.start(config)
+	f.send("BUSY ON")
+	waitFor(t, modem.Busy)
+	if _, err := modem.DialURL(url); err != ErrChannelBusy {
+		t.Fatalf("got %v, expected ErrChannelBusy", err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	const dwell = 100 * time.Millisecond
+	f := newFakeVARA(t)
+	modem, _ := NewModem("varahf", "N0CALL", f.config())
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := modem.Scan(ctx, []int{7101500, 10145500}, dwell); err == nil {
+		t.Fatal("expected error without a VFO")
+	}
+
+	vfo := make(fakeVFO)
+	modem.SetVFO(vfo)
+	done := make(chan error, 1)
+	go func() { done <- modem.Scan(ctx, []int{7101500, 10145500}, dwell) }()
+	f.expect("LISTEN ON")
+	for _, want := range []int{7101500, 10145500, 7101500} {
+		if got := <-vfo; got != want {
+			t.Fatalf("got QSY to %d, expected %d", got, want)
+		}
+	}
+
+	// Hold while busy, and while a session is in progress; nobody accepts it
+	f.send("BUSY ON")
+	f.send("PENDING")
+	f.send("BUSY OFF")
+	f.send("CONNECTED LA1B N0CALL 2300")
+	f.expect("DISCONNECT")
+	select {
+	case freq := <-vfo:
+		t.Fatalf("QSY to %d while held", freq)
+	case <-time.After(3 * dwell):
+	}
+	f.send("DISCONNECTED")
+	if got := <-vfo; got != 10145500 {
+		t.Fatalf("got QSY to %d after the session, expected 10145500", got)
+	}
+
+	cancel()
+	for {
+		select {
+		case <-vfo:
+			// Was about to QSY
+			continue
+		case err := <-done:
+			if err != context.Canceled {
+				t.Fatalf("got %v, expected context.Canceled", err)
+			}
+		}
+		break
+	}
+	f.expect("LISTEN OFF")
+}
+
+// recordingLogger records Printf output and discards debug output.
+type recordingLogger struct{ lines []string }
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) Debugf(format string, v ...interface{}) {}
+
+// fakePTT records PTT requests.
+type fakePTT chan bool
+
+func (p fakePTT) SetPTT(on bool) error {
+	p <- on
+	return nil
+}
+
+// fakeVFO records frequency changes.
+type fakeVFO chan int
+
+func (v fakeVFO) SetFreq(freq int) error {
+	v <- freq
+	return nil
+}
+
+// fakeVARA is a minimal stand-in for the VARA modem program. It accepts command and data
+// connections, acknowledges every command with OK and records the commands it receives. The most
+// recent connection of each kind is available from cmdConn and dataConn.
+type fakeVARA struct {
+	t        *testing.T
+	cmdLn    net.Listener
+	dataLn   net.Listener
+	cmds     chan string
+	cmdConn  chan net.Conn
+	dataConn chan net.Conn
+
+	mu       sync.Mutex
+	rejected map[string]bool // commands answered with WRONG
+	cmdConns int             // command connections accepted so far
+}
+
+func newFakeVARA(t *testing.T) *fakeVARA {
+	t.Helper()
+	f := &fakeVARA{
+		t:        t,
+		cmds:     make(chan string, 100),
+		cmdConn:  make(chan net.Conn, 1),
+		dataConn: make(chan net.Conn, 1),
+	}
+	// Like VARA, use adjacent command and data ports
+	for f.dataLn == nil {
+		var err error
+		if f.cmdLn, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		dataAddr := fmt.Sprintf("127.0.0.1:%d", f.cmdLn.Addr().(*net.TCPAddr).Port+1)
+		if f.dataLn, err = net.Listen("tcp", dataAddr); err != nil {
+			_ = f.cmdLn.Close()
+		}
+	}
+	t.Cleanup(func() {
+		_ = f.cmdLn.Close()
+		_ = f.dataLn.Close()
+	})
+	go func() {
+		for {
+			c, err := f.cmdLn.Accept()
+			if err != nil {
+				return
+			}
+			f.t.Cleanup(func() { _ = c.Close() })
+			f.mu.Lock()
+			f.cmdConns++
+			f.mu.Unlock()
+			replace(f.cmdConn, c)
+			go f.serveCmd(c)
+		}
+	}()
+	go func() {
+		for {
+			c, err := f.dataLn.Accept()
+			if err != nil {
+				return
+			}
+			f.t.Cleanup(func() { _ = c.Close() })
+			replace(f.dataConn, c)
+		}
+	}()
+	return f
+}
+
+// replace puts c in ch, dropping the connection already there, if any.
+func replace(ch chan net.Conn, c net.Conn) {
+	select {
+	case <-ch:
+	default:
+	}
+	ch <- c
+}
+
+func (f *fakeVARA) serveCmd(c net.Conn) {
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\r')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimSuffix(line, "\r")
+		f.cmds <- cmd
+		reply := "OK"
+		if cmd == "VERSION" {
+			reply = "VERSION 4.7.3"
+		}
+		f.mu.Lock()
+		if f.rejected[cmd] {
+			reply = "WRONG"
+		}
+		f.mu.Unlock()
+		_, _ = c.Write([]byte(reply + "\r"))
+	}
+}
+
+// relay plays VARA sending what the modem writes to data over the air, to the returned
+// connection, and back. It reports the TX buffer with BUFFER along the way, like VARA does, and
+// DISCONNECTED once the returned connection is closed.
+func (f *fakeVARA) relay(data net.Conn) net.Conn {
+	f.t.Helper()
+	cmdConn := <-f.cmdConn
+	f.cmdConn <- cmdConn
+	air, remote := net.Pipe()
+	f.t.Cleanup(func() { _ = air.Close() })
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := data.Read(buf)
+			if err != nil {
+				_ = air.Close()
+				return
+			}
+			fmt.Fprintf(cmdConn, "BUFFER %d\r", n)
+			if _, err := air.Write(buf[:n]); err != nil {
+				return
+			}
+			fmt.Fprintf(cmdConn, "BUFFER 0\r")
+		}
+	}()
+	go func() {
+		_, _ = io.Copy(data, air)
+		// The remote station hung up
+		fmt.Fprintf(cmdConn, "DISCONNECTED\r")
+	}()
+	return remote
+}
+
+// reject makes the fake answer cmd with WRONG.
+func (f *fakeVARA) reject(cmd string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rejected == nil {
+		f.rejected = make(map[string]bool)
+	}
+	f.rejected[cmd] = true
+}
+
+// config returns a ModemConfig pointing at the fake.
+func (f *fakeVARA) config() ModemConfig {
+	return ModemConfig{
+		Host:     "127.0.0.1",
+		CmdPort:  f.cmdLn.Addr().(*net.TCPAddr).Port,
+		DataPort: f.dataLn.Addr().(*net.TCPAddr).Port,
+	}
+}
+
+// start connects a new N0CALL modem to the fake's command port.
+func (f *fakeVARA) start(config ModemConfig) *Modem {
+	f.t.Helper()
+	modem, err := NewModem("varafm", "N0CALL", config)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	if err := modem.start(modem.configEndpoint()); err != nil {
+		f.t.Fatal(err)
+	}
+	f.expect("LISTEN OFF") // end of setup
+	return modem
+}
+
+// dial connects a new N0CALL modem to the fake and answers its CONNECT.
+func (f *fakeVARA) dial(config ModemConfig, rawurl string) net.Conn {
+	f.t.Helper()
+	url, err := transport.ParseURL(rawurl)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	modem, err := NewModem(url.Scheme, "N0CALL", config)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	res := make(chan result, 1)
+	go func() {
+		conn, err := modem.DialURL(url)
+		res <- result{conn, err}
+	}()
+	f.expect("CONNECT N0CALL " + url.Target)
+	f.send("CONNECTED N0CALL " + url.Target)
+	r := <-res
+	if r.err != nil {
+		f.t.Fatalf("DialURL failed: %v", r.err)
+	}
+	return r.conn
+}
+
+// expect waits for the modem to send cmd, skipping any other commands.
+func (f *fakeVARA) expect(cmd string) {
+	f.t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case got := <-f.cmds:
+			if got == cmd {
+				return
+			}
+		case <-timeout:
+			f.t.Fatalf("timeout waiting for command %q", cmd)
+		}
+	}
+}
+
+// notSent fails the test if the modem sends a command starting with prefix within d.
+func (f *fakeVARA) notSent(prefix string, d time.Duration) {
+	f.t.Helper()
+	timeout := time.After(d)
+	for {
+		select {
+		case got := <-f.cmds:
+			if strings.HasPrefix(got, prefix) {
+				f.t.Fatalf("unexpected command %q", got)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// send writes a command from the fake modem to the client.
+func (f *fakeVARA) send(cmd string) {
+	f.t.Helper()
+	c := <-f.cmdConn
+	defer func() {
+		// Put it back, unless a newer connection was accepted meanwhile
+		select {
+		case f.cmdConn <- c:
+		default:
+		}
+	}()
+	if _, err := c.Write([]byte(cmd + "\r")); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// waitFor polls cond until it returns true.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timeout waiting for condition")
+}